@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// admission bounds the bytes of request bodies being applied at once.
+// Peers and clients get separate pools so neither can starve the other.
+type admission struct {
+	mu       sync.Mutex
+	capacity int64
+	inFlight int64
+	admitted int
+	rejected int
+
+	// drain rate of the last full second, for Retry-After
+	rate     float64
+	released int64
+	since    time.Time
+}
+
+func newAdmission(capacity int64) *admission {
+	return &admission{capacity: capacity, since: time.Now()}
+}
+
+// acquire reserves n bytes without waiting. A body larger than the whole
+// pool is still let through when nothing else is in flight.
+func (a *admission) acquire(n int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.inFlight > 0 && a.inFlight+n > a.capacity {
+		a.rejected++
+		return false
+	}
+	a.inFlight += n
+	a.admitted++
+	return true
+}
+
+func (a *admission) release(n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inFlight -= n
+	a.released += n
+	if elapsed := time.Since(a.since); elapsed >= time.Second {
+		a.rate = float64(a.released) / elapsed.Seconds()
+		a.released = 0
+		a.since = time.Now()
+	}
+}
+
+// retryAfter estimates how long the bytes in flight take to drain, in
+// whole seconds between 1 and 30
+func (a *admission) retryAfter() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rate <= 0 {
+		return 1
+	}
+	seconds := math.Ceil(float64(a.inFlight) / a.rate)
+	return int(min(max(seconds, 1), 30))
+}
+
+type AdmissionStats struct {
+	InFlightBytes int64 `json:"inFlightBytes"`
+	CapacityBytes int64 `json:"capacityBytes"`
+	Admitted      int   `json:"admitted"`
+	Rejected      int   `json:"rejected"`
+}
+
+func (a *admission) stats() AdmissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return AdmissionStats{
+		InFlightBytes: a.inFlight,
+		CapacityBytes: a.capacity,
+		Admitted:      a.admitted,
+		Rejected:      a.rejected,
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// keys are spread over this many buckets, each hashed like the whole keyspace,
+// so a root mismatch can be narrowed to the buckets that actually differ
+const merkleBuckets = 256
+
+func bucketOf(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(sum[0]) % merkleBuckets
+}
+
+// entryDigest hashes an entry under the store lock, so the value is hashed
+// as is rather than quoted: quoting a value near largeValueBytes holds the
+// lock many times longer. Its length goes first so entries stay distinct.
+func entryDigest(key string, data Data) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %d %d %q %d %d ", key, data.Timestamp, data.Wall, data.Node, data.Version, len(data.Value))
+	io.WriteString(h, data.Value)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// toggleDigest XORs the digest of key's entry into its bucket, which adds
+// a new entry and takes out one that was added before, m.mu must be held
+func (m *LWWMap) toggleDigest(key string, data Data) {
+	sum := &m.buckets[bucketOf(key)]
+	entry := entryDigest(key, data)
+	for i := range sum {
+		sum[i] ^= entry[i]
+	}
+}
+
+func (m *LWWMap) bucketHashes() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hashes := make([]string, merkleBuckets)
+	for i, sum := range m.buckets {
+		hashes[i] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+// bucketOps returns the entries in the given buckets as operations
+func (m *LWWMap) bucketOps(buckets map[int]bool) []Patch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	operations := []Patch{}
+	for key, data := range m.store.All() {
+		if buckets[bucketOf(key)] {
+			operations = append(operations, data.patch(key))
+		}
+	}
+	return operations
+}
+
+func (m *LWWMap) Buckets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.bucketHashes())
+}
+
+// reconcile compares keyspace hashes with replica and, when they differ,
+// escalates to pushing every bucket whose hash doesn't match. The replica
+// does the same towards us on its own rounds, so both sides converge.
+func (m *LWWMap) reconcile(ctx context.Context, replica string) error {
+	operations, err := m.divergent(ctx, replica)
+	if err != nil || len(operations) == 0 {
+		return err
+	}
+	return m.push(ctx, replica, operations)
+}
+
+// divergent returns the local entries in every bucket whose hash differs
+// from replica's, or nothing when the keyspace hashes match
+func (m *LWWMap) divergent(ctx context.Context, replica string) ([]Patch, error) {
+	local, _ := m.keyspaceHash()
+	remote, err := m.transport.KeyspaceHash(ctx, replica)
+	if err != nil {
+		return nil, err
+	}
+	m.quarantine.learn(replica, remote.Node)
+	if local == remote.Hash {
+		return nil, nil
+	}
+
+	remoteBuckets, err := m.transport.BucketHashes(ctx, replica)
+	if err != nil {
+		return nil, err
+	}
+	if len(remoteBuckets) != merkleBuckets {
+		return nil, fmt.Errorf("replica %s returned %d buckets, expected %d", replica, len(remoteBuckets), merkleBuckets)
+	}
+
+	differing := make(map[int]bool)
+	for i, hash := range m.bucketHashes() {
+		if hash != remoteBuckets[i] {
+			differing[i] = true
+		}
+	}
+	operations := m.bucketOps(differing)
+	log.Printf("Node %s differs from %s in %d buckets, %d local entries to push", m.nodeID, replica, len(differing), len(operations))
+	return operations, nil
+}
+
+// ReconcileChange is an entry a reconcile overwrites, or creates, on the peer
+type ReconcileChange struct {
+	Key          string `json:"key"`
+	Exists       bool   `json:"exists"`
+	OldTimestamp Clock  `json:"oldTimestamp"`
+	NewTimestamp Clock  `json:"newTimestamp"`
+}
+
+type ReconcileReport struct {
+	Peer    string            `json:"peer"`
+	DryRun  bool              `json:"dryRun"`
+	Changes []ReconcileChange `json:"changes"`
+}
+
+// Reconcile reports which entries a push to ?peer= would change there, and
+// pushes them unless dryRun=true. Only entries the peer asks for after a
+// digest exchange are listed, so the report matches what the merge on the
+// peer would actually accept at that moment.
+func (m *LWWMap) Reconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	peer := r.URL.Query().Get("peer")
+	if !slices.Contains(m.replicas, peer) {
+		http.Error(w, "Unknown peer "+peer, http.StatusBadRequest)
+		return
+	}
+	report := ReconcileReport{Peer: peer, DryRun: r.URL.Query().Get("dryRun") == "true", Changes: []ReconcileChange{}}
+
+	ctx := r.Context()
+	operations, err := m.divergent(ctx, peer)
+	if err == nil && len(operations) > 0 {
+		operations, err = m.reconcileChanges(ctx, peer, operations, &report)
+	}
+	if err == nil && !report.DryRun && len(operations) > 0 {
+		err = m.push(ctx, peer, operations)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// reconcileChanges narrows operations to those peer would accept and
+// records each with the entry it replaces in report
+func (m *LWWMap) reconcileChanges(ctx context.Context, peer string, operations []Patch, report *ReconcileReport) ([]Patch, error) {
+	digests := make([]Digest, len(operations))
+	for i, op := range operations {
+		digests[i] = digestOf(op)
+	}
+	keys, err := m.transport.Wants(ctx, peer, digests)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	kept := []Patch{}
+	for _, op := range operations {
+		if !wanted[op.Key] {
+			continue
+		}
+		old, exists, err := m.transport.FetchKey(ctx, peer, op.Key)
+		if err != nil {
+			return nil, err
+		}
+		report.Changes = append(report.Changes, ReconcileChange{
+			Key:          op.Key,
+			Exists:       exists,
+			OldTimestamp: old.Timestamp,
+			NewTimestamp: op.Timestamp,
+		})
+		kept = append(kept, op)
+	}
+	return kept, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func reconcileAs(t *testing.T, m *LWWMap, query string) ReconcileReport {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Reconcile(w, httptest.NewRequest(http.MethodPost, "/reconcile?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("reconcile got status %d: %s", w.Code, w.Body)
+	}
+	var report ReconcileReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func changedKeys(report ReconcileReport) []string {
+	keys := []string{}
+	for _, change := range report.Changes {
+		keys = append(keys, change.Key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestReconcileDryRunMatchesReconcile(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	for _, key := range []string{"same1", "same2", "same3", "stale", "missing"} {
+		n0.ApplyClient(write(key, "v"))
+	}
+	// n1 holds the very same writes for the same keys, an older one for
+	// stale and nothing for missing
+	for _, key := range []string{"same1", "same2", "same3"} {
+		data := mustGet(t, n0, key)
+		n1.Apply([]Patch{data.patch(key)})
+	}
+	n1.Apply([]Patch{{Key: "stale", Value: "old", Timestamp: 1, Node: "n1", Version: 1}})
+
+	dryRun := reconcileAs(t, n0, "peer=n1&dryRun=true")
+	if keys := changedKeys(dryRun); !slices.Equal(keys, []string{"missing", "stale"}) {
+		t.Fatalf("dry run lists %v, want only the entries that differ", keys)
+	}
+	if writesHash(n1) == writesHash(n0) {
+		t.Fatal("dry run changed the peer")
+	}
+
+	applied := reconcileAs(t, n0, "peer=n1")
+	if !slices.Equal(changedKeys(applied), changedKeys(dryRun)) {
+		t.Fatalf("reconcile changed %v, dry run said %v", changedKeys(applied), changedKeys(dryRun))
+	}
+	// n1 counts a version past its stale entry, so only the writes match
+	if writesHash(n1) != writesHash(n0) {
+		t.Fatal("peer differs after reconcile")
+	}
+	if again := reconcileAs(t, n0, "peer=n1&dryRun=true"); len(again.Changes) != 0 {
+		t.Fatalf("a second dry run still lists %v", changedKeys(again))
+	}
+}
+
+func TestEscalationRepairsDivergence(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	for i := 0; i < 50; i++ {
+		n0.ApplyClient(write(fmt.Sprintf("k%d", i), "v"))
+	}
+
+	// a round gossips a handful of random keys, far fewer than differ, so
+	// only the escalation to buckets can bring n1 all of them
+	n0.syncRound(context.Background(), 0)
+
+	local, keys := n0.keyspaceHash()
+	if remote, remoteKeys := n1.keyspaceHash(); remote != local || remoteKeys != keys {
+		t.Fatalf("n1 has %d of %d keys after one round", remoteKeys, keys)
+	}
+}
+
+// the bucket hashes are kept up to date on every write, they must match
+// hashing the store from scratch
+func TestBucketHashesFollowWrites(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	for i := 0; i < 20; i++ {
+		n0.ApplyClient(write(fmt.Sprintf("k%d", i%7), itoa(Clock(i))))
+	}
+	n1.Apply(n0.snapshot())
+
+	for _, m := range nodes {
+		var sums [merkleBuckets][sha256.Size]byte
+		for _, op := range m.snapshot() {
+			entry := entryDigest(op.Key, mustGet(t, m, op.Key))
+			for i := range entry {
+				sums[bucketOf(op.Key)][i] ^= entry[i]
+			}
+		}
+		for i, hash := range m.bucketHashes() {
+			if hash != hex.EncodeToString(sums[i][:]) {
+				t.Fatalf("node %s bucket %d is %s, the store hashes to %x", m.nodeID, i, hash, sums[i])
+			}
+		}
+	}
+}
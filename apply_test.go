@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestClockAfterBatchIgnoresOutcome(t *testing.T) {
+	batch := []Patch{
+		{Key: "a", Value: "x", Timestamp: 30},
+		{Key: "b", Value: "x", Timestamp: 45},
+		{Key: "c", Value: "x", Timestamp: -1},
+	}
+
+	accepting := NewLWWMap("n0", nil)
+	accepting.clock = 50
+	// the replicated ops in the batch lose to what this node holds
+	rejecting := NewLWWMap("n0", nil)
+	rejecting.Apply([]Patch{
+		{Key: "a", Value: "y", Timestamp: 40},
+		{Key: "b", Value: "y", Timestamp: 48},
+		{Key: "c", Value: "y", Timestamp: 49},
+	})
+	rejecting.clock = 50
+
+	accepting.Apply(batch)
+	rejecting.Apply(batch)
+	if accepting.clock != 51 || rejecting.clock != 51 {
+		t.Fatalf("clocks %d and %d, want both 51", accepting.clock, rejecting.clock)
+	}
+}
+
+func TestUserOpStampedPastReplicatedOpInBatch(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.ApplyClient([]Patch{
+		{Key: "a", Value: "replicated", Timestamp: 60},
+		{Key: "b", Value: "user", Timestamp: -1},
+	})
+	replicated, user := mustGet(t, m, "a"), mustGet(t, m, "b")
+	if user.Timestamp <= replicated.Timestamp {
+		t.Fatalf("user op stamped %d, not after the replicated %d", user.Timestamp, replicated.Timestamp)
+	}
+	if m.clock <= user.Timestamp {
+		t.Fatalf("clock %d is not past %d", m.clock, user.Timestamp)
+	}
+}
+
+// TestHugeBatchLetsReadsIn applies one huge batch in chunks while a reader
+// spins on the store; it must see the batch partly applied at least once
+func TestHugeBatchLetsReadsIn(t *testing.T) {
+	const size, chunk = 50_000, 500
+	m := NewLWWMap("n0", nil)
+	m.applyChunk = chunk
+	operations := make([]Patch, size)
+	for i := range operations {
+		operations[i] = Patch{Key: strconv.Itoa(i), Value: "v", Timestamp: Clock(i + 1), Node: "n1"}
+	}
+
+	done := make(chan struct{})
+	partial := 0
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			m.mu.Lock()
+			if keys := m.store.Len(); keys > 0 && keys < size {
+				partial++
+			}
+			m.mu.Unlock()
+		}
+	}()
+	m.Apply(operations)
+	close(done)
+	wg.Wait()
+
+	if partial == 0 {
+		t.Fatal("no read got in while the batch was applied")
+	}
+	if _, keys := m.keyspaceHash(); keys != size {
+		t.Fatalf("got %d keys, want %d", keys, size)
+	}
+	stats := statsOf(t, m).ApplyLock
+	if stats.Applies != size/chunk {
+		t.Fatalf("got %d locked applies, want one per chunk", stats.Applies)
+	}
+	// no chunk holds the lock for much of the whole batch's time
+	if stats.MaxMillis > stats.TotalMillis/4 {
+		t.Fatalf("longest hold %.1fms of %.1fms in total", stats.MaxMillis, stats.TotalMillis)
+	}
+}
+
+func TestUnchunkedBatchIsOneApply(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	operations := make([]Patch, 5000)
+	for i := range operations {
+		operations[i] = Patch{Key: strconv.Itoa(i), Value: "v", Timestamp: Clock(i + 1), Node: "n1"}
+	}
+	m.Apply(operations)
+	if applies := statsOf(t, m).ApplyLock.Applies; applies != 1 {
+		t.Fatalf("got %d locked applies, want the batch applied at once", applies)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// peer returns the node a request comes from, or "" for a client. Anyone can
+// set X-Node-ID, so with a peer secret configured the header only counts
+// when the request also carries the secret; otherwise it is a client
+// request and goes through every client check.
+func (m *LWWMap) peer(r *http.Request) string {
+	peer := r.Header.Get(nodeHeader)
+	if peer == "" || m.peerSecret == "" {
+		return peer
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretHeader)), []byte(m.peerSecret)) != 1 {
+		return ""
+	}
+	return peer
+}
+
+// sign appends the HMAC of datagram under secret, if there is one
+func sign(datagram []byte, secret string) []byte {
+	if secret == "" {
+		return datagram
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(datagram)
+	return mac.Sum(datagram)
+}
+
+// verify checks and strips the HMAC sign appended
+func verify(datagram []byte, secret string) ([]byte, bool) {
+	if secret == "" {
+		return datagram, true
+	}
+	if len(datagram) < sha256.Size {
+		return nil, false
+	}
+	body, sum := datagram[:len(datagram)-sha256.Size], datagram[len(datagram)-sha256.Size:]
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return body, hmac.Equal(sum, mac.Sum(nil))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func patchAs(m *LWWMap, headers map[string]string, body string) int {
+	r := httptest.NewRequest(http.MethodPost, "/patch", strings.NewReader(body))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	m.Patch(w, r)
+	return w.Code
+}
+
+func TestPeerSecretGuardsClientChecks(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.peerSecret = "secret"
+	m.frozenKeys["k"] = true
+	body := `[{"key":"k","value":"v","timestamp":5}]`
+
+	if code := patchAs(m, map[string]string{nodeHeader: "n1"}, body); code != http.StatusLocked {
+		t.Fatalf("forged peer got status %d, want 423", code)
+	}
+	if code := patchAs(m, map[string]string{nodeHeader: "n1", secretHeader: "wrong"}, body); code != http.StatusLocked {
+		t.Fatalf("peer with the wrong secret got status %d, want 423", code)
+	}
+	if code := patchAs(m, map[string]string{nodeHeader: "n1", secretHeader: "secret"}, body); code != http.StatusOK {
+		t.Fatalf("peer got status %d, want 200", code)
+	}
+	if data := mustGet(t, m, "k"); data.Value != "v" {
+		t.Fatalf("got %q, want gossip to apply to the frozen key", data.Value)
+	}
+}
+
+func TestSignedDatagrams(t *testing.T) {
+	datagram := sign(encodeOps(1, "n1", write("k", "v")), "secret")
+
+	if _, ok := verify(datagram, "secret"); !ok {
+		t.Fatal("signed datagram did not verify")
+	}
+	if _, ok := verify(datagram, "other"); ok {
+		t.Fatal("datagram verified under another secret")
+	}
+	datagram[3] ^= 1
+	if _, ok := verify(datagram, "secret"); ok {
+		t.Fatal("tampered datagram verified")
+	}
+}
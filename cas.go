@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// CAS writes NewValue to Key only if the stored entry still has
+// ExpectedTimestamp. An ExpectedTimestamp of 0 means the key must not exist.
+type CAS struct {
+	Key               string `json:"key"`
+	ExpectedTimestamp Clock  `json:"expectedTimestamp"`
+	NewValue          string `json:"newValue"`
+}
+
+// CASFailure is the current state of a key whose expectation didn't hold
+type CASFailure struct {
+	Key       string `json:"key"`
+	Exists    bool   `json:"exists"`
+	Timestamp Clock  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// CASBatch applies every write in the batch or none of them. The check and
+// the writes happen under one hold of the store lock, so the guarantee is
+// local to this node: a concurrent write on another replica can still win
+// the merge afterwards. It goes through the same client checks as /patch,
+// except that during maintenance it is refused rather than queued, since
+// its expectations could not be checked when the queue drains.
+func (m *LWWMap) CASBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	release, admitted := m.admitBody(w, r, m.clientAdmission)
+	if !admitted {
+		return
+	}
+	defer release()
+
+	var batch []CAS
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil || len(batch) == 0 {
+		status := http.StatusBadRequest
+		if err != nil {
+			status = bodyErrorStatus(err)
+		}
+		http.Error(w, "Invalid request", status)
+		return
+	}
+
+	operations := make([]Patch, len(batch))
+	expected := make([]Clock, len(batch))
+	for i, cas := range batch {
+		operations[i] = Patch{Key: m.key(cas.Key), Value: cas.NewValue, Timestamp: -1}
+		expected[i] = cas.ExpectedTimestamp
+	}
+
+	write, admitted := m.admitClientWrite(w, r, operations, false)
+	if !admitted {
+		return
+	}
+	// checked on the keys the interceptors produced, which are the ones written
+	seen := make(map[string]bool, len(batch))
+	for _, op := range write.operations {
+		if seen[op.Key] {
+			http.Error(w, "Key "+op.Key+" appears more than once", http.StatusBadRequest)
+			return
+		}
+		seen[op.Key] = true
+	}
+
+	failures, results, err := m.compareAndApply(write.operations, expected)
+	if err != nil {
+		writeRejected(w, err)
+		return
+	}
+	if len(failures) > 0 {
+		for i, failure := range failures {
+			if !failure.Exists {
+				continue
+			}
+			data, err := m.afterRead(r.Context(), failure.Key, Data{Value: failure.Value, Timestamp: failure.Timestamp})
+			if err != nil {
+				log.Printf("Failed to read key %s: %v", failure.Key, err)
+				http.Error(w, "Failed to read key", http.StatusInternalServerError)
+				return
+			}
+			failures[i].Value = data.Value
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(failures)
+		return
+	}
+	m.afterApply(write.operations, results)
+	write.finish(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// compareAndApply merges operations only if every stored entry matches its
+// expected timestamp, otherwise it returns the entries that didn't. A write
+// to a claimed first-writer-wins key is rejected even if it matches.
+func (m *LWWMap) compareAndApply(operations []Patch, expected []Clock) ([]CASFailure, []OpResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if key, claimed := m.claimed(operations); claimed {
+		return nil, nil, &WriteRejection{Status: http.StatusConflict, Reason: "Key " + key + " is already claimed"}
+	}
+
+	var failures []CASFailure
+	for i, op := range operations {
+		existing, exists := m.store.Get(op.Key)
+		if (!exists && expected[i] == 0) || (exists && existing.Timestamp == expected[i]) {
+			continue
+		}
+		failures = append(failures, CASFailure{
+			Key:       op.Key,
+			Exists:    exists,
+			Timestamp: existing.Timestamp,
+			Value:     existing.Value,
+		})
+	}
+	if len(failures) > 0 {
+		return failures, nil, nil
+	}
+	return nil, m.merge(operations), nil
+}
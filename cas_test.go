@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCASBatch(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.ApplyClient(write("a", "a1"))
+	m.ApplyClient(write("b", "b1"))
+	a, b := mustGet(t, m, "a"), mustGet(t, m, "b")
+
+	t.Run("missing key with expectation 0", func(t *testing.T) {
+		w := casAs(m, nil, `[{"key":"new","expectedTimestamp":0,"newValue":"n"}]`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want 200", w.Code)
+		}
+		mustGet(t, m, "new")
+	})
+
+	t.Run("duplicate keys", func(t *testing.T) {
+		w := casAs(m, nil, `[{"key":"a","expectedTimestamp":`+itoa(a.Timestamp)+`,"newValue":"x"},{"key":"a","expectedTimestamp":`+itoa(a.Timestamp)+`,"newValue":"y"}]`)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d, want 400", w.Code)
+		}
+	})
+
+	t.Run("failed expectations apply nothing", func(t *testing.T) {
+		body := `[` +
+			`{"key":"a","expectedTimestamp":` + itoa(a.Timestamp) + `,"newValue":"a2"},` +
+			`{"key":"b","expectedTimestamp":` + itoa(b.Timestamp+100) + `,"newValue":"b2"},` +
+			`{"key":"new","expectedTimestamp":0,"newValue":"again"},` +
+			`{"key":"absent","expectedTimestamp":7,"newValue":"x"}]`
+		w := casAs(m, nil, body)
+		if w.Code != http.StatusConflict {
+			t.Fatalf("got status %d, want 409", w.Code)
+		}
+		var failures []CASFailure
+		if err := json.NewDecoder(w.Body).Decode(&failures); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]CASFailure{
+			"b":      {Key: "b", Exists: true, Timestamp: b.Timestamp, Value: "b1"},
+			"new":    {Key: "new", Exists: true, Timestamp: mustGet(t, m, "new").Timestamp, Value: "n"},
+			"absent": {Key: "absent"},
+		}
+		if len(failures) != len(want) {
+			t.Fatalf("got failures %+v, want %+v", failures, want)
+		}
+		for _, failure := range failures {
+			if failure != want[failure.Key] {
+				t.Fatalf("got failure %+v, want %+v", failure, want[failure.Key])
+			}
+		}
+		if data := mustGet(t, m, "a"); data.Value != "a1" {
+			t.Fatalf("a was written to %q although the batch failed", data.Value)
+		}
+	})
+
+	t.Run("matching expectations apply all", func(t *testing.T) {
+		body := `[` +
+			`{"key":"a","expectedTimestamp":` + itoa(a.Timestamp) + `,"newValue":"a2"},` +
+			`{"key":"b","expectedTimestamp":` + itoa(b.Timestamp) + `,"newValue":"b2"}]`
+		if w := casAs(m, nil, body); w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want 200", w.Code)
+		}
+		if mustGet(t, m, "a").Value != "a2" || mustGet(t, m, "b").Value != "b2" {
+			t.Fatal("batch was not applied")
+		}
+	})
+}
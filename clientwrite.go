@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// admitBody charges the request body to pool, answering 429 when the pool
+// is full. A chunked body is charged a flat largeValueBytes and held to it.
+// The returned func gives the bytes back.
+func (m *LWWMap) admitBody(w http.ResponseWriter, r *http.Request, pool *admission) (func(), bool) {
+	size := r.ContentLength
+	if size < 0 {
+		size = int64(m.largeValueBytes)
+	}
+	if !pool.acquire(size) {
+		w.Header().Set("Retry-After", strconv.Itoa(pool.retryAfter()))
+		http.Error(w, "Node is applying too much at once", http.StatusTooManyRequests)
+		return nil, false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, size)
+	return func() { pool.release(size) }, true
+}
+
+// clientWrite is a client batch that passed admitClientWrite
+type clientWrite struct {
+	m *LWWMap
+	// as the write interceptors rewrote them
+	operations []Patch
+	session    session
+	continued  bool
+}
+
+// admitClientWrite runs a decoded client batch through the checks every
+// client write goes through, answering w itself when one refuses it:
+// memory pressure, the write interceptors, virtual and frozen keys (as the
+// interceptors rewrote them), maintenance and the session token. During
+// maintenance the batch is queued with 202 if queue is set and refused with
+// 503 otherwise. First-writer-wins claims are checked when the batch is
+// applied, under the store lock.
+func (m *LWWMap) admitClientWrite(w http.ResponseWriter, r *http.Request, operations []Patch, queue bool) (*clientWrite, bool) {
+	if m.memory != nil && m.memory.pressured.Load() {
+		// gossip is still accepted so replicas converge; only new writes are shed
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Node is under memory pressure", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	operations, err := m.intercept(operations)
+	if err != nil {
+		writeRejected(w, err)
+		return nil, false
+	}
+	for _, op := range operations {
+		if _, virtual := m.virtualKey(m.key(op.Key)); virtual {
+			http.Error(w, "Key "+op.Key+" is virtual and read-only", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	m.mu.Lock()
+	key, frozen := m.frozen(operations)
+	m.mu.Unlock()
+	if frozen {
+		http.Error(w, "Key "+key+" is frozen", http.StatusLocked)
+		return nil, false
+	}
+
+	if queue {
+		queued, err := m.maintenance.enqueue(operations)
+		if err != nil {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return nil, false
+		}
+		if queued {
+			w.WriteHeader(http.StatusAccepted)
+			return nil, false
+		}
+	} else if m.maintenance.active() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Node is in maintenance", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	previous, continued, err := m.sessionWrite(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &clientWrite{m: m, operations: operations, session: previous, continued: continued}, true
+}
+
+// finish hands the client its session token once the write is applied
+func (c *clientWrite) finish(w http.ResponseWriter) {
+	w.Header().Set(sessionHeader, c.m.sessionToken(c.session, c.continued))
+}
+
+// writeRejected answers a refused write with the rejection's status, or 400
+func writeRejected(w http.ResponseWriter, err error) {
+	var rejection *WriteRejection
+	if errors.As(err, &rejection) {
+		http.Error(w, rejection.Reason, rejection.Status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
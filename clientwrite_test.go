@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func casAs(m *LWWMap, headers map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/casBatch", strings.NewReader(body))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	m.CASBatch(w, r)
+	return w
+}
+
+const casNew = `[{"key":"k","expectedTimestamp":0,"newValue":"v"}]`
+
+func TestCASRefusedDuringMaintenance(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.setMaintenance(true)
+
+	if w := casAs(m, nil, casNew); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("CAS got status %d, want 503", w.Code)
+	}
+	if code := patchAs(m, nil, `[{"key":"p","value":"v","timestamp":-1}]`); code != http.StatusAccepted {
+		t.Fatalf("patch got status %d, want 202", code)
+	}
+	m.setMaintenance(false)
+	if _, exists := m.lookup("k"); exists {
+		t.Fatal("CAS write was applied after maintenance")
+	}
+	mustGet(t, m, "p")
+}
+
+func TestCASShedUnderMemoryPressure(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.memory = newMemoryGuard(1)
+	m.memory.pressured.Store(true)
+
+	if w := casAs(m, nil, casNew); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", w.Code)
+	}
+}
+
+func TestCASChargedToClientAdmission(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.clientAdmission = newAdmission(16)
+	m.clientAdmission.acquire(16)
+
+	w := casAs(m, nil, casNew)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("got status %d, want 429 with Retry-After", w.Code)
+	}
+}
+
+func TestCASOnFrozenKeyIsLocked(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.frozenKeys["k"] = true
+	if w := casAs(m, nil, casNew); w.Code != http.StatusLocked {
+		t.Fatalf("got status %d, want 423", w.Code)
+	}
+}
+
+func TestCASOnClaimedKeyIsConflict(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.fwwPrefixes = []string{"lock/"}
+	m.ApplyClient(write("lock/k", "first"))
+	stored := mustGet(t, m, "lock/k")
+
+	body := `[{"key":"lock/k","expectedTimestamp":` + itoa(stored.Timestamp) + `,"newValue":"second"}]`
+	if w := casAs(m, nil, body); w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want 409", w.Code)
+	}
+	if data := mustGet(t, m, "lock/k"); data.Value != "first" {
+		t.Fatalf("claimed key was overwritten with %q", data.Value)
+	}
+}
+
+func TestCASHandsOutSessionToken(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	w := casAs(m, map[string]string{sessionHeader: "n1:40"}, casNew)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	if token := w.Header().Get(sessionHeader); token != "*:41" {
+		t.Fatalf("got token %q, want *:41", token)
+	}
+	if data := mustGet(t, m, "k"); data.Timestamp != 41 {
+		t.Fatalf("write stamped %d, want it after the session's writes", data.Timestamp)
+	}
+}
+
+func TestStrictUTF8(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.strictUTF8 = true
+	m.AddWriteInterceptor(RequireUTF8{})
+
+	if code := patchAs(m, nil, `[{"key":"ключ","value":"値 ✓","timestamp":-1}]`); code != http.StatusOK {
+		t.Fatalf("valid UTF-8 got status %d", code)
+	}
+	if data := mustGet(t, m, "ключ"); data.Value != "値 ✓" {
+		t.Fatalf("got %q back", data.Value)
+	}
+
+	if code := patchAs(m, nil, "[{\"key\":\"bad\",\"value\":\"\xff\xfe\",\"timestamp\":-1}]"); code != http.StatusBadRequest {
+		t.Fatalf("invalid bytes in the value got status %d, want 400", code)
+	}
+	if code := patchAs(m, nil, "[{\"key\":\"\xc3\",\"value\":\"v\",\"timestamp\":-1}]"); code != http.StatusBadRequest {
+		t.Fatalf("a truncated sequence in the key got status %d, want 400", code)
+	}
+	if _, keys := m.keyspaceHash(); keys != 1 {
+		t.Fatalf("got %d keys, want the invalid writes dropped", keys)
+	}
+
+	// writes that skip the handler meet the interceptor instead
+	err := m.ApplyClient(write("k", "\xff"))
+	var rejection *WriteRejection
+	if !errors.As(err, &rejection) || rejection.Status != http.StatusBadRequest {
+		t.Fatalf("direct invalid write gave %v, want 400", err)
+	}
+}
+
+func TestInvalidUTF8IsReplacedWhenNotStrict(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	if code := patchAs(m, nil, "[{\"key\":\"k\",\"value\":\"a\xffb\",\"timestamp\":-1}]"); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if data := mustGet(t, m, "k"); data.Value != "a�b" {
+		t.Fatalf("got %q, want the invalid byte replaced", data.Value)
+	}
+}
+
+func TestMemoryPressureShedsClientWritesUntilItEases(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.memory = newMemoryGuard(1000)
+	body := func(key string, timestamp int) string {
+		return `[{"key":"` + key + `","value":"v","timestamp":` + strconv.Itoa(timestamp) + `}]`
+	}
+	clientWrite := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.Patch(w, httptest.NewRequest(http.MethodPost, "/patch", strings.NewReader(body("c", -1))))
+		return w
+	}
+
+	if !m.memory.observe(1200) {
+		t.Fatal("passing the limit didn't report a change")
+	}
+	if w := clientWrite(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("got status %d, want 503 with Retry-After", w.Code)
+	}
+	if code := patchAs(m, map[string]string{nodeHeader: "n1"}, body("g", 5)); code != http.StatusOK {
+		t.Fatalf("gossip under pressure got status %d, want 200", code)
+	}
+
+	// just under the limit isn't enough to resume
+	m.memory.observe(950)
+	if w := clientWrite(); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d just under the limit, want 503", w.Code)
+	}
+	if !m.memory.observe(800) {
+		t.Fatal("dropping below the resume mark didn't report a change")
+	}
+	if w := clientWrite(); w.Code != http.StatusOK {
+		t.Fatalf("got status %d after pressure eased, want 200", w.Code)
+	}
+	mustGet(t, m, "c")
+	mustGet(t, m, "g")
+}
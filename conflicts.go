@@ -0,0 +1,33 @@
+package main
+
+import "log"
+
+// conflictStats counts writes that tied with the stored entry on timestamp
+// but carried different data, guarded by m.mu. Every conflict is counted;
+// only one in sampleRate is logged, none when sampleRate is 0.
+type conflictStats struct {
+	sampleRate int
+	total      int
+	sampled    int
+}
+
+type ConflictStats struct {
+	Total      int `json:"total"`
+	Sampled    int `json:"sampled"`
+	SampleRate int `json:"sampleRate"`
+}
+
+// recordConflict notes a tie between op and existing, m.mu must be held
+func (m *LWWMap) recordConflict(op Patch, existing Data, won bool) {
+	if op.Value == existing.Value && op.Wall == existing.Wall && op.Node == existing.Node {
+		return
+	}
+	c := &m.conflicts
+	c.total++
+	if c.sampleRate == 0 || c.total%c.sampleRate != 0 {
+		return
+	}
+	c.sampled++
+	log.Printf("Node %s resolved conflict on %s at timestamp %d: incoming %q (wall %d, node %s) vs stored %q (wall %d, node %s), incoming won=%t",
+		m.nodeID, op.Key, op.Timestamp, op.Value, op.Wall, op.Node, existing.Value, existing.Wall, existing.Node, won)
+}
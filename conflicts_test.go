@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestConflictsAreCountedAndSampled(t *testing.T) {
+	for _, rate := range []int{0, 1, 10} {
+		m := NewLWWMap("n0", nil)
+		m.conflicts.sampleRate = rate
+		for i := range 1000 {
+			key := "k" + strconv.Itoa(i)
+			stored := Patch{Key: key, Value: "a", Timestamp: 5, Node: "n1"}
+			m.Apply([]Patch{stored})
+			// redelivery of the same write is no conflict
+			m.Apply([]Patch{stored})
+			m.Apply([]Patch{{Key: key, Value: "b", Timestamp: 5, Node: "n2"}})
+		}
+
+		conflicts := statsOf(t, m).Conflicts
+		want := 0
+		if rate > 0 {
+			want = 1000 / rate
+		}
+		if conflicts.Total != 1000 || conflicts.Sampled != want || conflicts.SampleRate != rate {
+			t.Fatalf("got %+v at rate %d, want all 1000 counted and %d sampled", conflicts, rate, want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reads report the consistency mode they were actually served with
+const consistencyHeader = "X-Consistency"
+
+var (
+	errInvalidConsistency = errors.New("consistency must be local, local-bounded:<duration>, repair or quorum")
+	errNoQuorum           = errors.New("not enough replicas answered for a quorum read")
+)
+
+// prepareRead brings key up to date as the requested consistency demands
+// before it is read locally, and returns the mode actually used:
+//
+//   - local (default) reads the local store as is
+//   - repair merges in whatever every reachable replica holds first
+//   - quorum is repair that fails unless a majority of the cluster answered
+//   - local-bounded:<d> would serve locally when the entry is known fresh
+//     within d, but nodes keep no freshness estimates yet, so it repairs
+func (m *LWWMap) prepareRead(ctx context.Context, key string, consistency string) (string, error) {
+	switch {
+	case consistency == "" || consistency == "local":
+		return "local", nil
+	case consistency == "repair":
+		return "repair", m.repairRead(ctx, key, 0)
+	case consistency == "quorum":
+		// the local node counts towards the majority
+		return "quorum", m.repairRead(ctx, key, (len(m.replicas)+1)/2)
+	case strings.HasPrefix(consistency, "local-bounded:"):
+		if _, err := time.ParseDuration(strings.TrimPrefix(consistency, "local-bounded:")); err != nil {
+			return "", errInvalidConsistency
+		}
+		return "repair", m.repairRead(ctx, key, 0)
+	default:
+		return "", errInvalidConsistency
+	}
+}
+
+// repairRead fetches key from every replica and merges what they hold,
+// failing when fewer than need of them answered
+func (m *LWWMap) repairRead(ctx context.Context, key string, need int) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	answered := 0
+	operations := []Patch{}
+	for _, replica := range m.replicas {
+		wg.Add(1)
+		go func(replica string) {
+			defer wg.Done()
+			data, found, err := m.transport.FetchKey(ctx, replica, key)
+			if err != nil {
+				log.Printf("Repair read of %s from %s failed: %v", key, replica, err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			answered++
+			if found {
+				operations = append(operations, data.patch(key))
+			}
+		}(replica)
+	}
+	wg.Wait()
+
+	m.Apply(operations)
+	if answered < need {
+		return errNoQuorum
+	}
+	return nil
+}
+
+func consistencyStatus(err error) int {
+	if errors.Is(err, errInvalidConsistency) {
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func readWith(m *LWWMap, key, consistency string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	m.GetRaw(w, httptest.NewRequest(http.MethodGet, "/getRaw?key="+key+"&consistency="+consistency, nil))
+	return w
+}
+
+// staleCluster returns three nodes where only n1 has the latest write to k
+func staleCluster() []*LWWMap {
+	nodes, _ := newCluster(3, NewMemoryStore)
+	nodes[0].ApplyClient(write("k", "old"))
+	for _, node := range nodes[1:] {
+		node.Apply(nodes[0].snapshot())
+	}
+	nodes[1].ApplyClient(write("k", "new"))
+	return nodes
+}
+
+func TestConsistencyModes(t *testing.T) {
+	for _, test := range []struct {
+		consistency string
+		mode        string
+		value       string
+	}{
+		{"", "local", "old"},
+		{"local", "local", "old"},
+		{"repair", "repair", "new"},
+		{"quorum", "quorum", "new"},
+		// no freshness estimates are kept, so the bound can't be met
+		{"local-bounded:500ms", "repair", "new"},
+	} {
+		n0 := staleCluster()[0]
+		w := readWith(n0, "k", test.consistency)
+		if w.Code != http.StatusOK || w.Body.String() != test.value || w.Header().Get(consistencyHeader) != test.mode {
+			t.Fatalf("%q got status %d, %q in mode %q, want %q in mode %q",
+				test.consistency, w.Code, w.Body, w.Header().Get(consistencyHeader), test.value, test.mode)
+		}
+	}
+}
+
+func TestQuorumFailsOnADegradedCluster(t *testing.T) {
+	nodes := staleCluster()
+	n0 := nodes[0]
+	// two of five replicas answer, a quorum needs three besides n0
+	n0.replicas = append(n0.replicas, "gone1", "gone2", "gone3")
+	if w := readWith(n0, "k", "quorum"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", w.Code)
+	}
+	// repair and local-bounded make do with the replicas that answered
+	for _, consistency := range []string{"repair", "local-bounded:1s"} {
+		if w := readWith(n0, "k", consistency); w.Code != http.StatusOK || w.Body.String() != "new" {
+			t.Fatalf("%s got status %d and %q, want the repaired value", consistency, w.Code, w.Body)
+		}
+	}
+}
+
+func TestInvalidConsistencyIsRejected(t *testing.T) {
+	n0 := staleCluster()[0]
+	for _, consistency := range []string{"strong", "local-bounded:soon"} {
+		if w := readWith(n0, "k", consistency); w.Code != http.StatusBadRequest {
+			t.Fatalf("%q got status %d, want 400", consistency, w.Code)
+		}
+	}
+}
+
+// unanswered holds every key fetch until its context is done
+type unanswered struct{ *MemoryTransport }
+
+func (unanswered) FetchKey(ctx context.Context, replica string, key string) (Data, bool, error) {
+	<-ctx.Done()
+	return Data{}, false, ctx.Err()
+}
+
+func TestQuorumReadStopsWhenTheClientGoesAway(t *testing.T) {
+	nodes := staleCluster()
+	n0 := nodes[0]
+	n0.transport = unanswered{n0.transport.(*MemoryTransport)}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/getRaw?key=k&consistency=quorum", nil)
+	start := time.Now()
+	n0.GetRaw(w, r)
+	// repair reads give up on their own after 2s
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the read waited %v for replicas after the client left", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type Hash struct {
+	Hash string `json:"hash"`
+	Keys int    `json:"keys"`
+	// the node answering, so peers can tell which node is behind an address
+	Node string `json:"node,omitempty"`
+}
+
+type Convergence struct {
+	Converged bool     `json:"converged"`
+	Differing []string `json:"differing"`
+}
+
+func (m *LWWMap) Hash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hash, keys := m.keyspaceHash()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Hash{Hash: hash, Keys: keys, Node: m.nodeID})
+}
+
+// Converge pushes the whole keyspace to every replica and polls their hashes
+// until all of them match ours or the timeout passes. It is heavyweight and
+// meant for verification, not for regular traffic.
+func (m *LWWMap) Converge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := 30 * time.Second
+	if param := r.URL.Query().Get("timeout"); param != "" {
+		var err error
+		if timeout, err = time.ParseDuration(param); err != nil {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("Node %s converging with replicas %v", m.nodeID, m.replicas)
+	result := m.converge(r.Context(), timeout)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// converge gives up when the timeout passes or ctx is done, whichever is first
+func (m *LWWMap) converge(ctx context.Context, timeout time.Duration) Convergence {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		operations := m.snapshot()
+		differing := []string{}
+		for _, replica := range m.replicas {
+			if err := m.push(ctx, replica, operations); err != nil {
+				log.Printf("Failed to push keyspace to %s: %v", replica, err)
+				differing = append(differing, replica)
+				continue
+			}
+			local, _ := m.keyspaceHash()
+			remote, err := m.transport.KeyspaceHash(ctx, replica)
+			if err != nil || remote.Hash != local {
+				differing = append(differing, replica)
+			}
+		}
+
+		if len(differing) == 0 {
+			return Convergence{Converged: true, Differing: differing}
+		}
+		select {
+		case <-ctx.Done():
+			return Convergence{Converged: false, Differing: differing}
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// push sends operations as paced catch-up traffic in chunks, so a large
+// keyspace isn't one huge request
+func (m *LWWMap) push(ctx context.Context, replica string, operations []Patch) error {
+	for _, batch := range splitBatch(operations, 500, m.largeValueBytes) {
+		if err := m.send(ctx, m.catchUpLimit, replica, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot returns every entry as an operation that reproduces it. The copy
+// is taken under the store lock, so it is a point-in-time view: applies wait
+// until it is done and each locked batch (a chunk, with APPLY_CHUNK_SIZE) is
+// either wholly in it or not at all.
+func (m *LWWMap) snapshot() []Patch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	operations := make([]Patch, 0, m.store.Len())
+	for key, data := range m.store.All() {
+		operations = append(operations, data.patch(key))
+	}
+	return operations
+}
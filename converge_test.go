@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func postConverge(t *testing.T, m *LWWMap, timeout string) Convergence {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Converge(w, httptest.NewRequest(http.MethodPost, "/converge?timeout="+timeout, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d from /converge", w.Code)
+	}
+	var result Convergence
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestConvergeBringsReplicasUpToDate(t *testing.T) {
+	nodes, _ := newCluster(3, NewMemoryStore)
+	n0, n1, n2 := nodes[0], nodes[1], nodes[2]
+	n0.ApplyClient(write("a", "1"))
+	n1.Apply(n0.snapshot())
+	n0.ApplyClient(write("a", "2"))
+	n0.ApplyClient(write("b", "3"))
+
+	result := postConverge(t, n0, "5s")
+	if !result.Converged || len(result.Differing) != 0 {
+		t.Fatalf("got %+v, want converged", result)
+	}
+	for _, node := range []*LWWMap{n1, n2} {
+		if writesHash(node) != writesHash(n0) {
+			t.Fatalf("node %s differs after converging", node.nodeID)
+		}
+	}
+}
+
+func TestConvergeReportsReplicasThatStayBehind(t *testing.T) {
+	nodes, _ := newCluster(3, NewMemoryStore)
+	nodes[0].ApplyClient(write("a", "1"))
+	// a key only n2 has keeps its hash apart, since converge only pushes
+	nodes[2].ApplyClient(write("b", "2"))
+
+	result := postConverge(t, nodes[0], "50ms")
+	if result.Converged || !slices.Equal(result.Differing, []string{"n2"}) {
+		t.Fatalf("got %+v, want n2 differing", result)
+	}
+}
+
+func TestConvergeRejectsBadTimeout(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	w := httptest.NewRecorder()
+	m.Converge(w, httptest.NewRequest(http.MethodPost, "/converge?timeout=soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want 400", w.Code)
+	}
+}
+
+func TestConvergeStopsWhenTheClientGoesAway(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	// n1 keeps a key n0 lacks, so converging never succeeds on its own
+	nodes[1].ApplyClient(write("b", "2"))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/converge?timeout=30s", nil)
+	start := time.Now()
+	nodes[0].Converge(w, r)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("converge ran %v after the client left", elapsed)
+	}
+	var result Convergence
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || result.Converged {
+		t.Fatalf("got %+v, %v", result, err)
+	}
+}
+
+func TestPacedPushStopsWhenCancelled(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0 := nodes[0]
+	// each batch would wait minutes for its tokens
+	n0.catchUpLimit = newTokenBucket(100, 100)
+	operations := make([]Patch, 1000)
+	for i := range operations {
+		operations[i] = Patch{Key: strconv.Itoa(i), Value: "v", Timestamp: Clock(i + 1), Node: "n0"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := n0.push(ctx, "n1", operations); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("push waited %v past its deadline", elapsed)
+	}
+}
+
+// TestSnapshotIsPointInTime takes snapshots while writers apply batches that
+// set a group of keys to one value. A snapshot mixing values within a group
+// caught a batch half applied. Run with -race to check the copy too.
+func TestSnapshotIsPointInTime(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	var wg sync.WaitGroup
+	for writer := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			group := "g" + strconv.Itoa(writer) + "/"
+			for i := range 500 {
+				batch := make([]Patch, 8)
+				for k := range batch {
+					batch[k] = Patch{Key: group + strconv.Itoa(k), Value: strconv.Itoa(i), Timestamp: -1}
+				}
+				m.ApplyClient(batch)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for snapshots := 0; ; snapshots++ {
+		select {
+		case <-done:
+			if snapshots == 0 {
+				t.Fatal("the writers finished before any snapshot was taken")
+			}
+			return
+		default:
+		}
+		groups := map[string]string{}
+		counts := map[string]int{}
+		for _, op := range m.snapshot() {
+			group, _, _ := strings.Cut(op.Key, "/")
+			if value, seen := groups[group]; seen && value != op.Value {
+				t.Fatalf("snapshot has group %s at both %s and %s", group, value, op.Value)
+			}
+			groups[group] = op.Value
+			counts[group]++
+		}
+		for group, count := range counts {
+			if count != 8 {
+				t.Fatalf("snapshot has %d of group %s's 8 keys", count, group)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// fuzzWrite is one client write made on one node, followed by a gossip
+// step drawn from Gossip unless it is 0. Each write carries its own
+// schedule so that dropping it while shrinking leaves the rest unchanged.
+type fuzzWrite struct {
+	Node   int
+	Key    string
+	Value  string
+	Gossip int64
+}
+
+// randomWrites draws writes over a small key and value space so that keys
+// are overwritten and values collide
+func randomWrites(rng *rand.Rand, nodes, n int) []fuzzWrite {
+	writes := make([]fuzzWrite, n)
+	for i := range writes {
+		writes[i] = fuzzWrite{
+			Node:  rng.Intn(nodes),
+			Key:   fmt.Sprintf("k%d", rng.Intn(4)),
+			Value: fmt.Sprintf("v%d", rng.Intn(3)),
+		}
+		if rng.Intn(2) == 0 {
+			writes[i].Gossip = rng.Int63() + 1
+		}
+	}
+	return writes
+}
+
+// converges plays writes onto a fresh cluster, gossiping random subsets of
+// state between random nodes along the way with batches shuffled and
+// sometimes delivered twice. It then exchanges every node's state with every
+// other node in a random order, after which the winning writes must be the
+// same everywhere, and once more, after which the keyspace hashes must be
+// equal; it reports the first hashes that differ. The delivery schedule
+// depends only on seed, so a failing run is reproduced by the same writes
+// and seed.
+func converges(writes []fuzzWrite, seed int64, nodes int, newStore func() Store) (bool, []string) {
+	cluster, transport := newCluster(nodes, newStore)
+	ctx := context.Background()
+
+	gossip := func(rng *rand.Rand, to int, operations []Patch) {
+		rng.Shuffle(len(operations), func(i, j int) {
+			operations[i], operations[j] = operations[j], operations[i]
+		})
+		transport.SendOps(ctx, cluster[to].nodeID, operations)
+		if rng.Intn(4) == 0 {
+			// redelivery must be harmless
+			transport.SendOps(ctx, cluster[to].nodeID, operations)
+		}
+	}
+
+	for _, w := range writes {
+		cluster[w.Node].ApplyClient(write(w.Key, w.Value))
+		if w.Gossip != 0 {
+			rng := rand.New(rand.NewSource(w.Gossip))
+			from, to := rng.Intn(nodes), rng.Intn(nodes)
+			operations := cluster[from].snapshot()
+			gossip(rng, to, operations[:rng.Intn(len(operations)+1)])
+		}
+	}
+
+	// every node's state is taken before any of it is delivered, as if all
+	// nodes gossiped at once, so one exchange must be enough to agree on
+	// the winning writes
+	rng := rand.New(rand.NewSource(seed))
+	exchange := func() {
+		snapshots := make([][]Patch, nodes)
+		for i, node := range cluster {
+			snapshots[i] = node.snapshot()
+		}
+		for _, pair := range rng.Perm(nodes * nodes) {
+			if from, to := pair/nodes, pair%nodes; from != to {
+				gossip(rng, to, append([]Patch{}, snapshots[from]...))
+			}
+		}
+	}
+	agree := func(hash func(*LWWMap) string) (bool, []string) {
+		hashes := make([]string, nodes)
+		for i, node := range cluster {
+			hashes[i] = hash(node)
+		}
+		for _, hash := range hashes[1:] {
+			if hash != hashes[0] {
+				return false, hashes
+			}
+		}
+		return true, hashes
+	}
+
+	exchange()
+	if ok, hashes := agree(writesHash); !ok {
+		return false, hashes
+	}
+	// a node that merged a write over a different one counted a version
+	// past it, which takes one more exchange to reach the others
+	exchange()
+	return agree(func(m *LWWMap) string {
+		hash, _ := m.keyspaceHash()
+		return hash
+	})
+}
+
+// writesHash hashes m's entries like keyspaceHash but leaves out versions
+func writesHash(m *LWWMap) string {
+	var sum [sha256.Size]byte
+	for _, op := range m.snapshot() {
+		entry := entryDigest(op.Key, Data{Value: op.Value, Timestamp: op.Timestamp, Wall: op.Wall, Node: op.Node})
+		for i := range sum {
+			sum[i] ^= entry[i]
+		}
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// shrink drops writes one at a time for as long as the run still fails,
+// leaving a counterexample none of whose writes can be removed
+func shrink(writes []fuzzWrite, seed int64, nodes int, newStore func() Store) []fuzzWrite {
+	for i := 0; i < len(writes); {
+		candidate := append(append([]fuzzWrite{}, writes[:i]...), writes[i+1:]...)
+		if ok, _ := converges(candidate, seed, nodes, newStore); !ok {
+			writes = candidate
+			continue
+		}
+		i++
+	}
+	return writes
+}
+
+func checkConvergence(t *testing.T, writes []fuzzWrite, seed int64, nodes int, newStore func() Store) {
+	t.Helper()
+	if ok, _ := converges(writes, seed, nodes, newStore); ok {
+		return
+	}
+	minimal := shrink(writes, seed, nodes, newStore)
+	_, hashes := converges(minimal, seed, nodes, newStore)
+	t.Fatalf("nodes diverged with seed %d after %d writes; minimal counterexample %+v gives hashes %v",
+		seed, len(writes), minimal, hashes)
+}
+
+// backends are the stores the convergence suite runs against. Each returns
+// a newStore for one run, cleaned up with t.
+var backends = map[string]func(t testing.TB) func() Store{
+	"memory": func(testing.TB) func() Store { return NewMemoryStore },
+	"file": func(t testing.TB) func() Store {
+		dir := t.TempDir()
+		opened := 0
+		return func() Store {
+			opened++
+			store, err := OpenFileStore(filepath.Join(dir, fmt.Sprintf("store%d", opened)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.(*fileStore).file.Close() })
+			return store
+		}
+	},
+}
+
+func TestConvergence(t *testing.T) {
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			for seed := int64(0); seed < 200; seed++ {
+				t.Run(fmt.Sprint(seed), func(t *testing.T) {
+					rng := rand.New(rand.NewSource(seed))
+					nodes := 2 + rng.Intn(3)
+					checkConvergence(t, randomWrites(rng, nodes, 1+rng.Intn(30)), seed, nodes, backend(t))
+				})
+			}
+		})
+	}
+}
+
+func FuzzConvergence(f *testing.F) {
+	f.Add(int64(1), uint8(3), uint8(10))
+	f.Add(int64(42), uint8(2), uint8(40))
+	f.Fuzz(func(t *testing.T, seed int64, nodes uint8, n uint8) {
+		count := 2 + int(nodes)%4
+		rng := rand.New(rand.NewSource(seed))
+		checkConvergence(t, randomWrites(rng, count, int(n)), seed, count, NewMemoryStore)
+	})
+}
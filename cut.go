@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// cut keeps every entry overwritten while a consistent cut is exported, so
+// a node can still tell what it held at the barrier after a later write
+// replaced it. There is one cut at a time, exports are not meant to overlap.
+type cut struct {
+	retained map[string][]Data
+}
+
+// retain keeps existing, which key's new entry replaces
+func (c *cut) retain(key string, existing Data) {
+	c.retained[key] = append(c.retained[key], existing)
+}
+
+type CutState struct {
+	Clock Clock `json:"clock"`
+}
+
+// startCut starts keeping overwritten entries, unless a cut already does,
+// and returns the clock
+func (m *LWWMap) startCut() Clock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cut == nil {
+		m.cut = &cut{retained: make(map[string][]Data)}
+		log.Printf("Node %s started a cut at clock %d", m.nodeID, m.clock)
+	}
+	return m.clock
+}
+
+func (m *LWWMap) endCut() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cut = nil
+}
+
+// exportCut returns, for every key, the winner among the entries it held
+// with timestamps up to barrier, counting those overwritten since the cut
+// started
+func (m *LWWMap) exportCut(barrier Clock) []Patch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	operations := []Patch{}
+	for key, data := range m.store.All() {
+		var retained []Data
+		if m.cut != nil {
+			retained = m.cut.retained[key]
+		}
+		var best *Data
+		for _, entry := range append(retained, data) {
+			if entry.Timestamp > barrier {
+				continue
+			}
+			if best == nil || m.wins(key, entry.patch(key), *best) {
+				best = &entry
+			}
+		}
+		if best != nil {
+			operations = append(operations, best.patch(key))
+		}
+	}
+	return operations
+}
+
+// Cut serves the replica side of an export: POST starts a cut and returns
+// the clock, GET ?barrier= exports the entries as of the barrier and DELETE
+// ends the cut
+func (m *LWWMap) Cut(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CutState{Clock: m.startCut()})
+	case http.MethodGet:
+		barrier, err := strconv.Atoi(r.URL.Query().Get("barrier"))
+		if err != nil {
+			http.Error(w, "Invalid barrier", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.exportCut(Clock(barrier)))
+	case http.MethodDelete:
+		m.endCut()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+type Export struct {
+	Barrier Clock   `json:"barrier"`
+	Entries []Patch `json:"entries"`
+}
+
+// Export coordinates a consistent cut of the whole cluster and returns it.
+// Timestamps are Lamport clocks, so a write is always stamped above the
+// writes it could have seen, and a cut of everything up to one barrier
+// holds no effect without its cause.
+func (m *LWWMap) Export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	export, err := m.export(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+// export runs the cut over this node and every replica. Every node keeps
+// overwritten entries before any clock is read for the barrier, so an entry
+// replaced by a write stamped past the barrier is never lost: such a write
+// is stamped after its node reported a clock, by then every node keeps what
+// it overwrites. The nodes' exports are merged like replicated batches.
+func (m *LWWMap) export(ctx context.Context) (Export, error) {
+	defer func() {
+		m.endCut()
+		for _, replica := range m.replicas {
+			if err := m.transport.EndCut(context.WithoutCancel(ctx), replica); err != nil {
+				log.Printf("Node %s failed to end the cut on %s: %v", m.nodeID, replica, err)
+			}
+		}
+	}()
+
+	startAll := func() (Clock, error) {
+		barrier := m.startCut()
+		for _, replica := range m.replicas {
+			clock, err := m.transport.StartCut(ctx, replica)
+			if err != nil {
+				return 0, err
+			}
+			barrier = max(barrier, clock)
+		}
+		return barrier, nil
+	}
+	if _, err := startAll(); err != nil {
+		return Export{}, err
+	}
+	// only clocks read once every node keeps overwritten entries count
+	barrier, err := startAll()
+	if err != nil {
+		return Export{}, err
+	}
+
+	merged := make(map[string]Patch)
+	mergeAll := func(operations []Patch) {
+		for _, op := range operations {
+			if best, exists := merged[op.Key]; !exists || m.wins(op.Key, op, best.data()) {
+				merged[op.Key] = op
+			}
+		}
+	}
+	mergeAll(m.exportCut(barrier))
+	for _, replica := range m.replicas {
+		operations, err := m.transport.ExportCut(ctx, replica, barrier)
+		if err != nil {
+			return Export{}, err
+		}
+		mergeAll(operations)
+	}
+
+	export := Export{Barrier: barrier, Entries: make([]Patch, 0, len(merged))}
+	for _, op := range merged {
+		export.Entries = append(export.Entries, op)
+	}
+	log.Printf("Node %s exported %d entries at barrier %d", m.nodeID, len(export.Entries), barrier)
+	return export, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// interleaving runs writes once, just before the first export, when the
+// barrier is already picked
+type interleaving struct {
+	*MemoryTransport
+	once   sync.Once
+	writes func()
+}
+
+func (i *interleaving) ExportCut(ctx context.Context, replica string, barrier Clock) ([]Patch, error) {
+	i.once.Do(i.writes)
+	return i.MemoryTransport.ExportCut(ctx, replica, barrier)
+}
+
+func TestExportIsACausallyConsistentCut(t *testing.T) {
+	for seed := int64(0); seed < 50; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+			nodes, memory := newCluster(3, NewMemoryStore)
+
+			// effect<i> is written on a node that has seen cause<i> and holds
+			// the timestamp of the cause it saw
+			causal := func(i int) {
+				from, to := nodes[rng.Intn(len(nodes))], nodes[rng.Intn(len(nodes))]
+				key := "cause" + strconv.Itoa(i)
+				from.ApplyClient(write(key, "v"))
+				to.Apply(from.snapshot())
+				to.ApplyClient(write("effect"+strconv.Itoa(i), itoa(mustGet(t, to, key).Timestamp)))
+			}
+			for i := range 10 {
+				causal(i)
+			}
+			transport := &interleaving{MemoryTransport: memory, writes: func() {
+				// every cause is overwritten past the barrier everywhere,
+				// along with some effects
+				for i := range 10 {
+					if rng.Intn(2) == 0 {
+						causal(i)
+					}
+				}
+				for i := range 10 {
+					nodes[0].ApplyClient(write("cause"+strconv.Itoa(i), "later"))
+				}
+				for _, node := range nodes[1:] {
+					node.Apply(nodes[0].snapshot())
+				}
+			}}
+			for _, node := range nodes {
+				node.transport = transport
+			}
+
+			export, err := nodes[rng.Intn(len(nodes))].export(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := make(map[string]Patch)
+			for _, op := range export.Entries {
+				if op.Timestamp > export.Barrier {
+					t.Fatalf("%s at %d is past the barrier %d", op.Key, op.Timestamp, export.Barrier)
+				}
+				entries[op.Key] = op
+			}
+			for key, effect := range entries {
+				if !strings.HasPrefix(key, "effect") {
+					continue
+				}
+				seen, _ := strconv.Atoi(effect.Value)
+				cause, exists := entries["cause"+strings.TrimPrefix(key, "effect")]
+				if !exists || cause.Timestamp < Clock(seen) {
+					t.Fatalf("%s saw its cause at %d, the cut holds %+v", key, seen, cause)
+				}
+			}
+			if len(entries) < 20 {
+				t.Fatalf("cut holds %d entries, want every cause and effect written before it", len(entries))
+			}
+			for _, node := range nodes {
+				if node.cut != nil {
+					t.Fatalf("node %s still keeps overwritten entries", node.nodeID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Digest describes an entry without its value, so a peer can say whether
+// it needs the value before it is sent
+type Digest struct {
+	Key       string `json:"key"`
+	Timestamp Clock  `json:"timestamp"`
+	Wall      int64  `json:"wall,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Version   uint64 `json:"version,omitempty"`
+	Hash      string `json:"hash"`
+}
+
+// digestOf describes op with everything wants compares
+func digestOf(op Patch) Digest {
+	return Digest{Key: op.Key, Timestamp: op.Timestamp, Wall: op.Wall, Node: op.Node, Version: op.Version, Hash: valueHash(op.Value)}
+}
+
+func valueHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// wants returns the keys among digests whose values would change the local
+// store: missing keys, entries the digest beats, equal timestamps with
+// different data, where the tie-break may need the value itself, and the
+// same write at a higher version
+func (m *LWWMap) wants(digests []Digest) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := []string{}
+	for _, digest := range digests {
+		key := m.key(digest.Key)
+		existing, exists := m.store.Get(key)
+		switch {
+		case !exists:
+		case digest.Timestamp == existing.Timestamp:
+			if digest.Wall == existing.Wall && digest.Node == existing.Node && digest.Hash == valueHash(existing.Value) && digest.Version <= existing.Version {
+				continue
+			}
+		case !m.wins(key, Patch{Key: key, Timestamp: digest.Timestamp}, existing):
+			continue
+		}
+		keys = append(keys, digest.Key)
+	}
+	return keys
+}
+
+func (m *LWWMap) Digest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var digests []Digest
+	if err := json.NewDecoder(r.Body).Decode(&digests); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.wants(digests))
+}
+
+// wanted trims operations to those replica asks for after seeing their
+// digests. If the replica can't answer, every operation is kept.
+func (m *LWWMap) wanted(ctx context.Context, replica string, operations []Patch) []Patch {
+	digests := make([]Digest, len(operations))
+	for i, op := range operations {
+		digests[i] = digestOf(op)
+	}
+
+	keys, err := m.transport.Wants(ctx, replica, digests)
+	if err != nil {
+		log.Printf("Node %s failed to exchange digests with %s, sending values: %v", m.nodeID, replica, err)
+		return operations
+	}
+
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	kept := operations[:0]
+	for _, op := range operations {
+		if wanted[op.Key] {
+			kept = append(kept, op)
+		}
+	}
+	log.Printf("Node %s sending %d of %d values to %s after digest exchange", m.nodeID, len(kept), len(operations), replica)
+	return kept
+}
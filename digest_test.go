@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// wireBytes counts the JSON the HTTP transport would put on the wire for a
+// digest exchange, and for whatever else is passed to count
+type wireBytes struct {
+	*MemoryTransport
+	bytes int
+}
+
+func (w *wireBytes) count(v any) {
+	data, _ := json.Marshal(v)
+	w.bytes += len(data)
+}
+
+func (w *wireBytes) Wants(ctx context.Context, replica string, digests []Digest) ([]string, error) {
+	w.count(digests)
+	keys, err := w.MemoryTransport.Wants(ctx, replica, digests)
+	w.count(keys)
+	return keys, err
+}
+
+// sharedCluster returns two nodes holding the same entries with large
+// values, except that n0 has rewritten changed of them since
+func sharedCluster(entries, changed int) (*LWWMap, *LWWMap, *wireBytes) {
+	nodes, memory := newCluster(2, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	value := strings.Repeat("x", 4096)
+	for i := range entries {
+		n0.ApplyClient(write("k"+strconv.Itoa(i), value))
+	}
+	n1.Apply(n0.snapshot())
+	for i := range changed {
+		n0.ApplyClient(write("k"+strconv.Itoa(i), value+"!"))
+	}
+	transport := &wireBytes{MemoryTransport: memory}
+	n0.transport = transport
+	return n0, n1, transport
+}
+
+func TestDigestsSendOnlyChangedValues(t *testing.T) {
+	n0, n1, _ := sharedCluster(100, 3)
+	kept := n0.wanted(context.Background(), "n1", n0.snapshot())
+	if len(kept) != 3 {
+		t.Fatalf("got %d values to send, want the 3 changed", len(kept))
+	}
+	n0.send(context.Background(), nil, "n1", kept)
+	if writesHash(n0) != writesHash(n1) {
+		t.Fatal("n1 differs after receiving the changed values")
+	}
+}
+
+// BenchmarkMetadataFirstGossip reports the bytes one round puts on the wire
+// when peers share 99% of 1000 4KiB values, sending everything against
+// exchanging digests first
+func BenchmarkMetadataFirstGossip(b *testing.B) {
+	for _, metadataFirst := range []bool{false, true} {
+		b.Run("metadataFirst="+strconv.FormatBool(metadataFirst), func(b *testing.B) {
+			n0, _, transport := sharedCluster(1000, 10)
+			ctx := context.Background()
+			b.ResetTimer()
+			for range b.N {
+				operations := n0.snapshot()
+				if metadataFirst {
+					operations = n0.wanted(ctx, "n1", operations)
+				}
+				// counted but not delivered, so every round sees the same drift
+				transport.count(operations)
+			}
+			b.ReportMetric(float64(transport.bytes)/float64(b.N), "wire-bytes/round")
+		})
+	}
+}
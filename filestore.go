@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"log"
+	"os"
+	"strconv"
+)
+
+// fileStore keeps entries in an append-only file of checksummed JSON lines,
+// after a header line naming the file's schema, and only their offsets in
+// memory, so values don't have to fit in RAM. Opening it replays the file to
+// rebuild the offsets. Overwritten entries are never
+// reclaimed, so the file grows with every write. Writes aren't fsynced: they
+// survive the process crashing but not the machine losing power, and the
+// entries lost with the tail are filled in again by anti-entropy.
+type fileStore struct {
+	file  *os.File
+	size  int64
+	index map[string]span
+	// deflate entries that come out shorter for it; entries are read one
+	// at a time by offset, so each is compressed on its own. Reads handle
+	// both kinds whatever this is set to.
+	compress bool
+}
+
+// span locates an entry's line in the file
+type span struct {
+	offset int64
+	length int
+}
+
+type fileEntry struct {
+	Key  string `json:"key"`
+	Data Data   `json:"data"`
+}
+
+// OpenFileStore opens or creates the store at path, migrating a file of an
+// older schema first. A line cut short by a crash mid-write is truncated
+// away.
+func OpenFileStore(path string) (Store, error) {
+	if err := migrateStore(path); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileStore{file: file, index: make(map[string]span)}
+
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadBytes('\n')
+	switch {
+	case errors.Is(err, io.EOF):
+		// new, or torn before its header was complete
+		header = schemaHeader(storeSchema)
+		if _, err := file.WriteAt(header, 0); err != nil {
+			file.Close()
+			return nil, err
+		}
+		s.size = int64(len(header))
+		if err := file.Truncate(s.size); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return s, nil
+	case err != nil:
+		file.Close()
+		return nil, err
+	}
+	s.size, err = replayEntries(reader, int64(len(header)), func(entry fileEntry, sp span) {
+		s.index[entry.Key] = sp
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(s.size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// replayEntries decodes the entry lines reader yields from offset on, calling fn
+// with each entry and where it is. A last line without its newline was cut
+// short and is left out. It returns the offset past the last whole line.
+func replayEntries(reader *bufio.Reader, offset int64, fn func(fileEntry, span)) (int64, error) {
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		entry, err := decodeEntry(line)
+		if err != nil {
+			return offset, fmt.Errorf("corrupt entry at offset %d: %w", offset, err)
+		}
+		fn(entry, span{offset: offset, length: len(line)})
+		offset += int64(len(line))
+	}
+}
+
+// compressed entries are base64 deflated JSON after this byte, which JSON
+// never starts with
+const compressedEntry = 'z'
+
+// encodeEntry returns entry's line: the CRC-32 of its payload in hex, then
+// the payload, which is the entry's JSON or, when compress is set and it is
+// shorter, its compressed form
+func encodeEntry(entry fileEntry, compress bool) ([]byte, error) {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if compress {
+		var deflated bytes.Buffer
+		writer, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+		writer.Write(encoded)
+		writer.Close()
+		if size := 1 + base64.StdEncoding.EncodedLen(deflated.Len()); size < len(encoded) {
+			compressed := make([]byte, size)
+			compressed[0] = compressedEntry
+			base64.StdEncoding.Encode(compressed[1:], deflated.Bytes())
+			encoded = compressed
+		}
+	}
+	line := fmt.Appendf(nil, "%08x ", crc32.ChecksumIEEE(encoded))
+	line = append(line, encoded...)
+	return append(line, '\n'), nil
+}
+
+func decodeEntry(line []byte) (fileEntry, error) {
+	var entry fileEntry
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if len(line) < 9 || line[8] != ' ' {
+		return entry, errors.New("missing checksum")
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return entry, fmt.Errorf("invalid checksum: %w", err)
+	}
+	payload := line[9:]
+	if crc32.ChecksumIEEE(payload) != uint32(sum) {
+		return entry, errors.New("checksum mismatch")
+	}
+	if len(payload) > 0 && payload[0] == compressedEntry {
+		deflated := make([]byte, base64.StdEncoding.DecodedLen(len(payload)-1))
+		n, err := base64.StdEncoding.Decode(deflated, payload[1:])
+		if err != nil {
+			return entry, err
+		}
+		if payload, err = io.ReadAll(flate.NewReader(bytes.NewReader(deflated[:n]))); err != nil {
+			return entry, err
+		}
+	}
+	return entry, json.Unmarshal(payload, &entry)
+}
+
+// read loads the entry at sp. The store can't report errors through the
+// Store interface, and serving on after losing entries would be worse than
+// restarting and replaying the file, so I/O failures are fatal.
+func (s *fileStore) read(sp span) fileEntry {
+	line := make([]byte, sp.length)
+	if _, err := s.file.ReadAt(line, sp.offset); err != nil {
+		log.Fatalf("Failed to read store %s at offset %d: %v", s.file.Name(), sp.offset, err)
+	}
+	entry, err := decodeEntry(line)
+	if err != nil {
+		log.Fatalf("Corrupt entry in store %s at offset %d: %v", s.file.Name(), sp.offset, err)
+	}
+	return entry
+}
+
+func (s *fileStore) Get(key string) (Data, bool) {
+	sp, exists := s.index[key]
+	if !exists {
+		return Data{}, false
+	}
+	return s.read(sp).Data, true
+}
+
+func (s *fileStore) Set(key string, data Data) {
+	line, err := encodeEntry(fileEntry{Key: key, Data: data}, s.compress)
+	if err != nil {
+		log.Fatalf("Failed to encode entry %s: %v", key, err)
+	}
+	if _, err := s.file.WriteAt(line, s.size); err != nil {
+		log.Fatalf("Failed to write store %s: %v", s.file.Name(), err)
+	}
+	s.index[key] = span{offset: s.size, length: len(line)}
+	s.size += int64(len(line))
+}
+
+func (s *fileStore) Len() int {
+	return len(s.index)
+}
+
+func (s *fileStore) All() iter.Seq2[string, Data] {
+	return func(yield func(string, Data) bool) {
+		for key, sp := range s.index {
+			if !yield(key, s.read(sp).Data) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFileStoreReplaysOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("a", Data{Value: "1", Timestamp: 1, Node: "n0"})
+	store.Set("b", Data{Value: "2", Timestamp: 2})
+	store.Set("a", Data{Value: "3", Timestamp: 3})
+	store.(*fileStore).file.Close()
+
+	// a crash mid-append leaves a partial line behind
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	file.WriteString(`{"key":"c","da`)
+	file.Close()
+
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.(*fileStore).file.Close()
+	if reopened.Len() != 2 {
+		t.Fatalf("got %d keys, want 2", reopened.Len())
+	}
+	if data, _ := reopened.Get("a"); data.Value != "3" {
+		t.Fatalf("got %+v for a, want the last write", data)
+	}
+
+	// the map picks its clock up from the replayed entries
+	m := NewLWWMapWithStore("n0", nil, nil, reopened)
+	m.ApplyClient(write("d", "4"))
+	if data := mustGet(t, m, "d"); data.Timestamp != 4 {
+		t.Fatalf("new write stamped %d, want 4", data.Timestamp)
+	}
+}
+
+func TestValueIndexCoversReopenedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewLWWMapWithStore("n0", nil, nil, store)
+	m.ApplyClient(write("a", "x"))
+	m.ApplyClient(write("b", "x"))
+	m.ApplyClient(write("a", "y"))
+	store.(*fileStore).file.Close()
+
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.(*fileStore).file.Close()
+	m = NewLWWMapWithStore("n0", nil, nil, reopened)
+	m.enableValueIndex()
+	if keys := m.index.lookup("x"); !slices.Equal(keys, []string{"b"}) {
+		t.Fatalf("got %v for x, want [b]", keys)
+	}
+	// an entry from before the restart leaves the index when overwritten
+	m.ApplyClient(write("b", "z"))
+	if keys := m.index.lookup("x"); len(keys) != 0 {
+		t.Fatalf("got %v for x after overwriting b, want none", keys)
+	}
+}
+
+// failing refuses every batch, as if the peer were down
+type failing struct{ *MemoryTransport }
+
+func (failing) SendOps(ctx context.Context, replica string, operations []Patch) error {
+	return errors.New("connection refused")
+}
+
+// there is no queue of pending sends to persist: the writes are in the
+// store, and the first round after a restart pushes whatever the peer lacks
+func TestWritesAreResentAfterARestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := NewMemoryTransport()
+	n1 := NewLWWMap("n1", []string{"n0"})
+	transport.Register("n1", n1)
+	n0 := NewLWWMapWithStore("n0", []string{"n1"}, failing{transport}, store)
+	transport.Register("n0", n0)
+	for i := range 20 {
+		n0.ApplyClient(write(fmt.Sprintf("k%d", i), "v"))
+	}
+	n0.syncRound(context.Background(), 0)
+	if _, keys := n1.keyspaceHash(); keys != 0 {
+		t.Fatalf("n1 got %d keys over a failing transport", keys)
+	}
+	// the node crashes before its next round
+	store.(*fileStore).file.Close()
+
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.(*fileStore).file.Close()
+	n0 = NewLWWMapWithStore("n0", []string{"n1"}, transport, reopened)
+	transport.Register("n0", n0)
+	n0.syncRound(context.Background(), 0)
+
+	local, _ := n0.keyspaceHash()
+	if remote, keys := n1.keyspaceHash(); remote != local {
+		t.Fatalf("n1 has %d of 20 keys after the restarted node's first round", keys)
+	}
+}
+
+func TestCompressedStoreReplaysTheSame(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string) *fileStore {
+		store, err := OpenFileStore(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.(*fileStore).file.Close() })
+		return store.(*fileStore)
+	}
+	plain, compressed := open("plain"), open("compressed")
+	compressed.compress = true
+	for i := range 50 {
+		data := Data{Value: strings.Repeat(fmt.Sprintf("text %d ", i%7), i), Timestamp: Clock(i + 1), Node: "n0", Version: 1}
+		plain.Set(fmt.Sprintf("k%d", i%20), data)
+		compressed.Set(fmt.Sprintf("k%d", i%20), data)
+	}
+	if compressed.size >= plain.size/2 {
+		t.Fatalf("compressed store is %d bytes, plain %d", compressed.size, plain.size)
+	}
+	plain.file.Close()
+	compressed.file.Close()
+
+	// a store written compressed reads back without compression set
+	replayedPlain, replayedCompressed := open("plain"), open("compressed")
+	if replayedCompressed.Len() != replayedPlain.Len() {
+		t.Fatalf("got %d keys compressed, %d plain", replayedCompressed.Len(), replayedPlain.Len())
+	}
+	for key, data := range replayedPlain.All() {
+		if other, _ := replayedCompressed.Get(key); other != data {
+			t.Fatalf("%s is %+v compressed, %+v plain", key, other, data)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type Freeze struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+}
+
+// frozen reports the first key in operations that clients may not write,
+// m.mu must be held
+func (m *LWWMap) frozen(operations []Patch) (string, bool) {
+	for _, op := range operations {
+		key := m.key(op.Key)
+		if m.frozenKeys[key] {
+			return key, true
+		}
+		for prefix := range m.frozenPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (m *LWWMap) Freeze(w http.ResponseWriter, r *http.Request) {
+	m.setFrozen(w, r, true)
+}
+
+func (m *LWWMap) Unfreeze(w http.ResponseWriter, r *http.Request) {
+	m.setFrozen(w, r, false)
+}
+
+func (m *LWWMap) setFrozen(w http.ResponseWriter, r *http.Request, frozen bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var freeze Freeze
+	if err := json.NewDecoder(r.Body).Decode(&freeze); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if (freeze.Key == "") == (freeze.Prefix == "") {
+		http.Error(w, "Exactly one of key or prefix is required", http.StatusBadRequest)
+		return
+	}
+
+	freeze.Key, freeze.Prefix = m.key(freeze.Key), m.key(freeze.Prefix)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case freeze.Key != "" && frozen:
+		m.frozenKeys[freeze.Key] = true
+	case freeze.Key != "":
+		delete(m.frozenKeys, freeze.Key)
+	case frozen:
+		m.frozenPrefixes[freeze.Prefix] = true
+	default:
+		delete(m.frozenPrefixes, freeze.Prefix)
+	}
+	log.Printf("Node %s set frozen=%t for %+v", m.nodeID, frozen, freeze)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func post(handler http.Handler, path, body string) int {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	return w.Code
+}
+
+func TestFreezeAndUnfreeze(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	routes := m.routes("")
+	patchKey := func(key string) int {
+		return post(routes, "/patch", `[{"key":"`+key+`","value":"v","timestamp":-1}]`)
+	}
+
+	if code := post(routes, "/freeze", `{"key":"k"}`); code != http.StatusOK {
+		t.Fatalf("freezing a key got status %d", code)
+	}
+	if code := post(routes, "/freeze", `{"prefix":"cfg/"}`); code != http.StatusOK {
+		t.Fatalf("freezing a prefix got status %d", code)
+	}
+	for _, key := range []string{"k", "cfg/a"} {
+		if code := patchKey(key); code != http.StatusLocked {
+			t.Fatalf("write to frozen %s got status %d, want 423", key, code)
+		}
+	}
+	if code := patchKey("other"); code != http.StatusOK {
+		t.Fatalf("write to an unfrozen key got status %d", code)
+	}
+
+	post(routes, "/unfreeze", `{"key":"k"}`)
+	post(routes, "/unfreeze", `{"prefix":"cfg/"}`)
+	for _, key := range []string{"k", "cfg/a"} {
+		if code := patchKey(key); code != http.StatusOK {
+			t.Fatalf("write to unfrozen %s got status %d", key, code)
+		}
+	}
+}
+
+func TestFreezeNeedsExactlyOneTarget(t *testing.T) {
+	routes := NewLWWMap("n0", nil).routes("")
+	for _, body := range []string{`{}`, `{"key":"k","prefix":"p"}`, `not json`} {
+		if code := post(routes, "/freeze", body); code != http.StatusBadRequest {
+			t.Fatalf("freezing %s got status %d, want 400", body, code)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/what-the-fawk/crdt
+
+go 1.23
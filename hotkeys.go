@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/maphash"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	sketchDepth   = 4
+	sketchWidth   = 2048
+	hotCandidates = 64
+	hotHalfLife   = time.Minute
+)
+
+type HotKey struct {
+	Key   string  `json:"key"`
+	Count float64 `json:"count"`
+}
+
+// hotKeys estimates per-key write frequency with a count-min sketch whose
+// counters halve every hotHalfLife, and keeps the heaviest keys it has seen
+// as candidates for reporting
+type hotKeys struct {
+	seeds      [sketchDepth]maphash.Seed
+	counts     [sketchDepth][sketchWidth]float64
+	candidates map[string]float64
+	lastDecay  time.Time
+}
+
+func newHotKeys() *hotKeys {
+	h := &hotKeys{
+		candidates: make(map[string]float64),
+		lastDecay:  time.Now(),
+	}
+	for i := range h.seeds {
+		h.seeds[i] = maphash.MakeSeed()
+	}
+	return h
+}
+
+func (h *hotKeys) record(key string) {
+	if time.Since(h.lastDecay) >= hotHalfLife {
+		h.decay()
+	}
+
+	estimate := 0.0
+	for i := range h.counts {
+		cell := &h.counts[i][maphash.String(h.seeds[i], key)%sketchWidth]
+		*cell++
+		if i == 0 || *cell < estimate {
+			estimate = *cell
+		}
+	}
+
+	if _, exists := h.candidates[key]; exists || len(h.candidates) < hotCandidates {
+		h.candidates[key] = estimate
+		return
+	}
+	coldest, coldestCount := "", estimate
+	for candidate, count := range h.candidates {
+		if count < coldestCount {
+			coldest, coldestCount = candidate, count
+		}
+	}
+	if coldest != "" {
+		delete(h.candidates, coldest)
+		h.candidates[key] = estimate
+	}
+}
+
+func (h *hotKeys) decay() {
+	for i := range h.counts {
+		for j := range h.counts[i] {
+			h.counts[i][j] /= 2
+		}
+	}
+	for key := range h.candidates {
+		h.candidates[key] /= 2
+	}
+	h.lastDecay = time.Now()
+}
+
+func (h *hotKeys) top(n int) []HotKey {
+	keys := make([]HotKey, 0, len(h.candidates))
+	for key, count := range h.candidates {
+		keys = append(keys, HotKey{Key: key, Count: count})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys[:min(n, len(keys))]
+}
+
+func (m *LWWMap) HotKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := 10
+	if param := r.URL.Query().Get("top"); param != "" {
+		var err error
+		if n, err = strconv.Atoi(param); err != nil || n <= 0 {
+			http.Error(w, "Invalid top", http.StatusBadRequest)
+			return
+		}
+	}
+
+	m.mu.Lock()
+	keys := m.hotKeys.top(n)
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
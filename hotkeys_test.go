@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeavilyWrittenKeyIsHottest(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	for i := range 200 {
+		m.ApplyClient(write(fmt.Sprintf("cold%d", i), "v"))
+		if i%2 == 0 {
+			m.ApplyClient(write("hot", "v"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	m.HotKeys(w, httptest.NewRequest(http.MethodGet, "/hotkeys?top=3", nil))
+	var keys []HotKey
+	if err := json.NewDecoder(w.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0].Key != "hot" {
+		t.Fatalf("got %+v, want hot first of 3", keys)
+	}
+	if keys[0].Count < 100 {
+		t.Fatalf("hot counted %v times, written 100", keys[0].Count)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// valueIndex maps each stored value to the keys currently holding it. It is
+// maintained by set, so only winning writes ever enter it.
+type valueIndex struct {
+	keys map[string]map[string]struct{}
+}
+
+func newValueIndex() *valueIndex {
+	return &valueIndex{
+		keys: make(map[string]map[string]struct{}),
+	}
+}
+
+// enableValueIndex starts indexing values, the ones already in the store
+// included, m.mu must be held
+func (m *LWWMap) enableValueIndex() {
+	m.index = newValueIndex()
+	for key, data := range m.store.All() {
+		m.index.add(data.Value, key)
+	}
+}
+
+func (i *valueIndex) add(value, key string) {
+	keys, exists := i.keys[value]
+	if !exists {
+		keys = make(map[string]struct{})
+		i.keys[value] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (i *valueIndex) remove(value, key string) {
+	keys := i.keys[value]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(i.keys, value)
+	}
+}
+
+func (i *valueIndex) lookup(value string) []string {
+	keys := make([]string, 0, len(i.keys[value]))
+	for key := range i.keys[value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *LWWMap) ByValue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if m.index == nil {
+		http.Error(w, "Value index is disabled", http.StatusNotFound)
+		return
+	}
+
+	value := r.URL.Query().Get("value")
+
+	m.mu.Lock()
+	keys := m.index.lookup(value)
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
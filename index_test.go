@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func byValue(t *testing.T, m *LWWMap, value string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.ByValue(w, httptest.NewRequest(http.MethodGet, "/byValue?value="+value, nil))
+	var keys []string
+	if err := json.NewDecoder(w.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestValueIndexFollowsWinningWrites(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.enableValueIndex()
+	m.ApplyClient(write("a", "x"))
+	m.ApplyClient(write("b", "x"))
+	m.ApplyClient(write("c", "y"))
+	if keys := byValue(t, m, "x"); !slices.Equal(keys, []string{"a", "b"}) {
+		t.Fatalf("got %v for x, want [a b]", keys)
+	}
+
+	// an update moves the key to its new value
+	m.ApplyClient(write("a", "y"))
+	if keys := byValue(t, m, "x"); !slices.Equal(keys, []string{"b"}) {
+		t.Fatalf("got %v for x after updating a, want [b]", keys)
+	}
+	if keys := byValue(t, m, "y"); !slices.Equal(keys, []string{"a", "c"}) {
+		t.Fatalf("got %v for y after updating a, want [a c]", keys)
+	}
+
+	// a write that loses the merge never enters the index
+	m.Apply([]Patch{{Key: "b", Value: "stale", Timestamp: 1, Node: "n1"}})
+	if keys := byValue(t, m, "stale"); len(keys) != 0 {
+		t.Fatalf("losing write is indexed under %v", keys)
+	}
+	if keys := byValue(t, m, "x"); !slices.Equal(keys, []string{"b"}) {
+		t.Fatalf("got %v for x after a losing write, want [b]", keys)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+type OpResult struct {
+	Applied   bool
+	Timestamp Clock
+}
+
+// WriteInterceptor hooks into the write path. BeforeApply may rewrite an op
+// or reject it; AfterApply sees the outcome once the op has been merged.
+// Interceptors run in registration order for client writes, and for
+// replicated writes too when interceptReplicated is set.
+type WriteInterceptor interface {
+	BeforeApply(op Patch) (Patch, error)
+	AfterApply(op Patch, result OpResult)
+}
+
+// WriteRejection refuses a write with a specific HTTP status. BeforeApply
+// returns it, and so does the apply path for writes to claimed keys.
+type WriteRejection struct {
+	Status int
+	Reason string
+}
+
+func (e *WriteRejection) Error() string {
+	return e.Reason
+}
+
+func (m *LWWMap) AddWriteInterceptor(interceptor WriteInterceptor) {
+	m.interceptors = append(m.interceptors, interceptor)
+}
+
+// beforeApply runs every op through the chain, failing the whole batch on the
+// first rejection
+func (m *LWWMap) beforeApply(operations []Patch) ([]Patch, error) {
+	rewritten := make([]Patch, len(operations))
+	for i, op := range operations {
+		for _, interceptor := range m.interceptors {
+			var err error
+			if op, err = callBeforeApply(interceptor, op); err != nil {
+				return nil, err
+			}
+		}
+		rewritten[i] = op
+	}
+	return rewritten, nil
+}
+
+func (m *LWWMap) afterApply(operations []Patch, results []OpResult) {
+	for i, op := range operations {
+		for _, interceptor := range m.interceptors {
+			callAfterApply(interceptor, op, results[i])
+		}
+	}
+}
+
+// a panicking interceptor fails the write instead of taking the node down
+func callBeforeApply(interceptor WriteInterceptor, op Patch) (rewritten Patch, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("write interceptor %T panicked: %v", interceptor, recovered)
+		}
+	}()
+	return interceptor.BeforeApply(op)
+}
+
+func callAfterApply(interceptor WriteInterceptor, op Patch, result OpResult) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("Write interceptor %T panicked after applying %s: %v", interceptor, op.Key, recovered)
+		}
+	}()
+	interceptor.AfterApply(op, result)
+}
+
+// ReadInterceptor transforms a value on its way out of Get and GetRaw. The
+// context is the request's, so anything attached to it reaches the hook.
+type ReadInterceptor interface {
+	AfterRead(ctx context.Context, key string, data Data) (Data, error)
+}
+
+// AddReadInterceptor registers a read hook. Read hooks run in reverse
+// registration order, so a type registered for both writes and reads unwraps
+// values in the opposite order they were wrapped.
+func (m *LWWMap) AddReadInterceptor(interceptor ReadInterceptor) {
+	m.readInterceptors = append(m.readInterceptors, interceptor)
+}
+
+func (m *LWWMap) afterRead(ctx context.Context, key string, data Data) (Data, error) {
+	for i := len(m.readInterceptors) - 1; i >= 0; i-- {
+		var err error
+		if data, err = m.readInterceptors[i].AfterRead(ctx, key, data); err != nil {
+			return data, err
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// exclaim appends to every value and records results
+type exclaim struct{ seen []OpResult }
+
+func (e *exclaim) BeforeApply(op Patch) (Patch, error) {
+	op.Value += "!"
+	return op, nil
+}
+
+func (e *exclaim) AfterApply(op Patch, result OpResult) {
+	e.seen = append(e.seen, result)
+}
+
+type panics struct{}
+
+func (panics) BeforeApply(op Patch) (Patch, error)  { panic("boom") }
+func (panics) AfterApply(op Patch, result OpResult) {}
+
+func TestInterceptorsRewriteAndObserve(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	e := &exclaim{}
+	m.AddWriteInterceptor(e)
+
+	if err := m.ApplyClient(write("k", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if data := mustGet(t, m, "k"); data.Value != "v!" {
+		t.Fatalf("stored %q, want the rewritten value", data.Value)
+	}
+	if len(e.seen) != 1 || !e.seen[0].Applied {
+		t.Fatalf("AfterApply saw %+v", e.seen)
+	}
+
+	// replicated writes skip the chain unless asked
+	m.Apply([]Patch{{Key: "r", Value: "v", Timestamp: 100}})
+	if data := mustGet(t, m, "r"); data.Value != "v" {
+		t.Fatalf("replicated write was rewritten to %q", data.Value)
+	}
+}
+
+func TestPanickingInterceptorFailsTheWrite(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.AddWriteInterceptor(panics{})
+	if err := m.ApplyClient(write("k", "v")); err == nil {
+		t.Fatal("write went through a panicking interceptor")
+	}
+	if _, exists := m.lookup("k"); exists {
+		t.Fatal("write was applied")
+	}
+}
+
+func TestRewrittenKeysAreChecked(t *testing.T) {
+	newMap := func() *LWWMap {
+		m := NewLWWMap("n0", nil)
+		m.AddWriteInterceptor(&RewritePrefix{From: "src/", To: "dst/"})
+		return m
+	}
+	body := func(key string) string {
+		return `[{"key":"` + key + `","value":"v","timestamp":-1}]`
+	}
+
+	frozen := newMap()
+	frozen.frozenKeys["dst/a"] = true
+	if code := patchAs(frozen, nil, body("src/a")); code != http.StatusLocked {
+		t.Fatalf("write into a frozen key got status %d, want 423", code)
+	}
+
+	virtual := newMap()
+	virtual.RegisterVirtualKey("dst/v", func() string { return "" })
+	if code := patchAs(virtual, nil, body("src/v")); code != http.StatusBadRequest {
+		t.Fatalf("write into a virtual key got status %d, want 400", code)
+	}
+
+	claimed := newMap()
+	claimed.fwwPrefixes = []string{"dst/"}
+	claimed.Apply([]Patch{{Key: "dst/c", Value: "first", Timestamp: 1}})
+	if code := patchAs(claimed, nil, body("src/c")); code != http.StatusConflict {
+		t.Fatalf("write into a claimed key got status %d, want 409", code)
+	}
+
+	direct := newMap()
+	err := direct.ApplyClient(write("dst/a", "v"))
+	var rejection *WriteRejection
+	if !errors.As(err, &rejection) || rejection.Status != http.StatusForbidden {
+		t.Fatalf("direct write to the destination gave %v, want 403", err)
+	}
+}
+
+func benchmarkApplyClient(b *testing.B, interceptors int) {
+	m := NewLWWMap("n0", nil)
+	for range interceptors {
+		m.AddWriteInterceptor(&RewritePrefix{From: "src/", To: "dst/"})
+	}
+	operations := make([]Patch, 100)
+	for i := range operations {
+		operations[i] = Patch{Key: fmt.Sprintf("k%d", i), Value: "v", Timestamp: -1}
+	}
+	b.ResetTimer()
+	for range b.N {
+		if err := m.ApplyClient(operations); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkApplyClientEmptyChain(b *testing.B) { benchmarkApplyClient(b, 0) }
+
+func BenchmarkApplyClientOneInterceptor(b *testing.B) { benchmarkApplyClient(b, 1) }
+
+func TestReplicatedOpsAreNotEncryptedAgain(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	encrypt, err := NewEncryptValues(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		node.AddWriteInterceptor(encrypt)
+		node.AddReadInterceptor(encrypt)
+		node.interceptReplicated = true
+	}
+	n0, n1 := nodes[0], nodes[1]
+	n0.ApplyClient(write("k", "secret"))
+	n1.Apply(n0.snapshot())
+
+	if stored, replicated := mustGet(t, n0, "k"), mustGet(t, n1, "k"); stored != replicated {
+		t.Fatalf("n1 stored %+v, n0 %+v", replicated, stored)
+	}
+	data, _, _, err := n1.read(context.Background(), "k")
+	if err != nil || data.Value != "secret" {
+		t.Fatalf("n1 read %q, %v", data.Value, err)
+	}
+}
+
+// reverse reverses values on write and back on read
+type reverse struct{}
+
+func (reverse) BeforeApply(op Patch) (Patch, error) {
+	runes := []rune(op.Value)
+	slices.Reverse(runes)
+	op.Value = string(runes)
+	return op, nil
+}
+
+func (reverse) AfterApply(op Patch, result OpResult) {}
+
+func (r reverse) AfterRead(ctx context.Context, key string, data Data) (Data, error) {
+	op, _ := r.BeforeApply(Patch{Value: data.Value})
+	data.Value = op.Value
+	return data, nil
+}
+
+func TestReadHooksUnwrapInReverse(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	encrypt, err := NewEncryptValues(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written as reverse then encrypt, so reads must decrypt before reversing
+	m.AddWriteInterceptor(reverse{})
+	m.AddReadInterceptor(reverse{})
+	m.AddWriteInterceptor(encrypt)
+	m.AddReadInterceptor(encrypt)
+
+	if err := m.ApplyClient(write("k", "secret")); err != nil {
+		t.Fatal(err)
+	}
+	if stored := mustGet(t, m, "k"); strings.Contains(stored.Value, "secret") || strings.Contains(stored.Value, "terces") {
+		t.Fatalf("stored the plaintext: %q", stored.Value)
+	}
+
+	w := httptest.NewRecorder()
+	m.Get(w, httptest.NewRequest(http.MethodPost, "/getKey", strings.NewReader(`{"key":"k"}`)))
+	var data Data
+	if err := json.NewDecoder(w.Body).Decode(&data); err != nil || data.Value != "secret" {
+		t.Fatalf("got %q, %v from /getKey, want the round trip", data.Value, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// EncryptValues stores values AES-GCM encrypted and base64 encoded, so the
+// plaintext never reaches the store or the peers. Registered as a read
+// interceptor too, it decrypts values on the way out.
+type EncryptValues struct {
+	aead cipher.AEAD
+}
+
+func NewEncryptValues(key []byte) (*EncryptValues, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptValues{aead: aead}, nil
+}
+
+// BeforeApply leaves replicated ops alone, which carry their origin's
+// ciphertext already when replicated writes are intercepted too
+func (e *EncryptValues) BeforeApply(op Patch) (Patch, error) {
+	if op.Timestamp >= 0 {
+		return op, nil
+	}
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return op, err
+	}
+	sealed := e.aead.Seal(nonce, nonce, []byte(op.Value), []byte(op.Key))
+	op.Value = base64.StdEncoding.EncodeToString(sealed)
+	return op, nil
+}
+
+func (e *EncryptValues) AfterApply(op Patch, result OpResult) {}
+
+func (e *EncryptValues) AfterRead(ctx context.Context, key string, data Data) (Data, error) {
+	sealed, err := base64.StdEncoding.DecodeString(data.Value)
+	if err != nil {
+		return data, err
+	}
+	if len(sealed) < e.aead.NonceSize() {
+		return data, errors.New("encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():]
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return data, err
+	}
+	data.Value = string(plaintext)
+	return data, nil
+}
+
+// RewritePrefix moves client writes from one key prefix to another, and
+// rejects writes that already target the destination directly
+type RewritePrefix struct {
+	From string
+	To   string
+}
+
+func (p *RewritePrefix) BeforeApply(op Patch) (Patch, error) {
+	if strings.HasPrefix(op.Key, p.To) {
+		return op, &WriteRejection{Status: http.StatusForbidden, Reason: "Keys under " + p.To + " are written via " + p.From}
+	}
+	if rest, found := strings.CutPrefix(op.Key, p.From); found {
+		op.Key = p.To + rest
+	}
+	return op, nil
+}
+
+func (p *RewritePrefix) AfterApply(op Patch, result OpResult) {}
+
+// RequireUTF8 rejects writes whose key or value isn't valid UTF-8
+type RequireUTF8 struct{}
+
+func (RequireUTF8) BeforeApply(op Patch) (Patch, error) {
+	if !utf8.ValidString(op.Key) || !utf8.ValidString(op.Value) {
+		return op, &WriteRejection{Status: http.StatusBadRequest, Reason: "Key and value must be valid UTF-8"}
+	}
+	return op, nil
+}
+
+func (RequireUTF8) AfterApply(op Patch, result OpResult) {}
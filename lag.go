@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type ReplicaLag struct {
+	Found     bool   `json:"found"`
+	Timestamp Clock  `json:"timestamp"`
+	Lag       Clock  `json:"lag"`
+	Error     string `json:"error,omitempty"`
+}
+
+type KeyLag struct {
+	Key       string                `json:"key"`
+	Found     bool                  `json:"found"`
+	Timestamp Clock                 `json:"timestamp"`
+	MaxLag    Clock                 `json:"maxLag"`
+	Replicas  map[string]ReplicaLag `json:"replicas"`
+}
+
+// Lag asks every replica for its timestamp of a key and reports how far each
+// trails the local one. Replicas missing the key lag by the whole timestamp.
+func (m *LWWMap) Lag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	local, found := m.lookup(key)
+	result := KeyLag{
+		Key:       key,
+		Found:     found,
+		Timestamp: local.Timestamp,
+		Replicas:  make(map[string]ReplicaLag, len(m.replicas)),
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, replica := range m.replicas {
+		wg.Add(1)
+		go func(replica string) {
+			defer wg.Done()
+			var lag ReplicaLag
+			data, exists, err := m.transport.FetchKey(ctx, replica, key)
+			if err != nil {
+				lag.Error = err.Error()
+			} else {
+				lag.Found = exists
+				lag.Timestamp = data.Timestamp
+				lag.Lag = max(0, local.Timestamp-data.Timestamp)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Replicas[replica] = lag
+			if err == nil {
+				result.MaxLag = max(result.MaxLag, lag.Lag)
+			}
+		}(replica)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
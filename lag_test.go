@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func lagOf(t *testing.T, m *LWWMap, key string) KeyLag {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Lag(w, httptest.NewRequest(http.MethodGet, "/lag?key="+key, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d from /lag", w.Code)
+	}
+	var lag KeyLag
+	if err := json.NewDecoder(w.Body).Decode(&lag); err != nil {
+		t.Fatal(err)
+	}
+	return lag
+}
+
+func TestLagShowsWhichReplicasTrail(t *testing.T) {
+	nodes, _ := newCluster(4, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	n0.ApplyClient(write("a", "1"))
+	n1.Apply(n0.snapshot())
+	stale := mustGet(t, n0, "a").Timestamp
+	for range 5 {
+		n0.ApplyClient(write("a", "2"))
+	}
+	nodes[2].Apply(n0.snapshot())
+	latest := mustGet(t, n0, "a").Timestamp
+	// a replica that can't be reached reports an error, not a lag
+	n0.replicas = append(n0.replicas, "gone")
+
+	lag := lagOf(t, n0, "a")
+	if !lag.Found || lag.Timestamp != latest {
+		t.Fatalf("got local %+v, want found at %d", lag, latest)
+	}
+	if got := lag.Replicas["n1"]; !got.Found || got.Lag != latest-stale {
+		t.Fatalf("got %+v for n1, want a lag of %d", got, latest-stale)
+	}
+	if got := lag.Replicas["n2"]; !got.Found || got.Lag != 0 {
+		t.Fatalf("got %+v for the up to date n2", got)
+	}
+	if got := lag.Replicas["n3"]; got.Found || got.Lag != latest {
+		t.Fatalf("got %+v for n3 without the key, want the whole timestamp", got)
+	}
+	if got := lag.Replicas["gone"]; got.Error == "" {
+		t.Fatalf("got %+v for an unreachable replica", got)
+	}
+	if lag.MaxLag != latest {
+		t.Fatalf("got max lag %d, want %d", lag.MaxLag, latest)
+	}
+}
@@ -2,18 +2,37 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 type Clock int
 
+// set on gossip requests so the receiver can tell them apart from client writes
+const nodeHeader = "X-Node-ID"
+
+// carries the shared peer secret, without which X-Node-ID isn't trusted
+const secretHeader = "X-Peer-Secret"
+
+// applies holding the store lock longer than this are logged
+const slowApply = 100 * time.Millisecond
+
 type Comparison int
 
 const (
@@ -27,6 +46,14 @@ type Patch struct {
 	Key       string `json:"key"`
 	Value     string `json:"value"`
 	Timestamp Clock  `json:"timestamp"`
+	// wall-clock nanoseconds when the write was stamped, 0 if not captured;
+	// breaks ties between equal timestamps before the value does
+	Wall int64 `json:"wall,omitempty"`
+	// node that stamped the write, breaks ties after the wall clock
+	Node string `json:"node,omitempty"`
+	// the key's version once this write won, see Data.Version; 0 for user
+	// writes, which are counted when stamped
+	Version uint64 `json:"version,omitempty"`
 }
 
 type Get struct {
@@ -36,53 +63,368 @@ type Get struct {
 type Data struct {
 	Value     string
 	Timestamp Clock
+	Wall      int64  `json:",omitempty"`
+	Node      string `json:",omitempty"`
+	// counts the writes that won on this key, starting at 1. It travels
+	// with the entry, and a replica that had merged some other write counts
+	// a winner past it, even one that only won a tie-break. Replicas then
+	// settle on the highest count for the same write, so once they converge
+	// they report the same version, and it never goes down on any of them.
+	Version uint64
+}
+
+// patch returns the operation that reproduces the entry under key
+func (d Data) patch(key string) Patch {
+	return Patch{Key: key, Value: d.Value, Timestamp: d.Timestamp, Wall: d.Wall, Node: d.Node, Version: d.Version}
+}
+
+// data returns the entry op stores as is
+func (p Patch) data() Data {
+	return Data{Value: p.Value, Timestamp: p.Timestamp, Wall: p.Wall, Node: p.Node, Version: p.Version}
 }
 
 type LWWMap struct {
-	mu       sync.Mutex
-	store    map[string]Data
-	clock    Clock
-	nodeID   string
-	replicas []string
+	mu        sync.Mutex
+	store     Store
+	clock     Clock
+	nodeID    string
+	replicas  []string
+	transport Transport
+
+	quarantine *quarantine
+	// shared by every node to prove a request comes from a peer, empty
+	// trusts X-Node-ID alone
+	peerSecret string
+
+	// shared backing copies of values, nil unless deduplication is enabled
+	values *valuePool
+
+	// keys by value, nil unless the index is enabled
+	index *valueIndex
+
+	// records incoming replication batches, nil unless recording is enabled
+	recorder *recorder
+
+	scheduler *syncScheduler
+	peers     *peerSelector
+	changes   int
+	changed   chan struct{}
+	// XOR of the entry digests in each bucket, kept up to date by set so
+	// hashing the keyspace doesn't walk the store
+	buckets [merkleBuckets][sha256.Size]byte
+
+	// outbound byte limits for gossip rounds and for catch-up pushes, nil means unlimited
+	steadyLimit  *tokenBucket
+	catchUpLimit *tokenBucket
+	// values at least this large are sent in a request of their own
+	largeValueBytes int
+
+	// write rates since the node started; a file store keeps entries but not
+	// how often they were written, so they start from nothing after a restart
+	hotKeys *hotKeys
+
+	// keys and prefixes closed to client writes; gossip still applies, so
+	// without a peer secret a client claiming X-Node-ID gets past them
+	frozenKeys     map[string]bool
+	frozenPrefixes map[string]bool
+
+	interceptors        []WriteInterceptor
+	interceptReplicated bool
+	readInterceptors    []ReadInterceptor
+
+	// guards virtualKeys alone, since computing a virtual value may take m.mu
+	virtualMu   sync.RWMutex
+	virtualKeys map[string]func() string
+
+	strictUTF8 bool
+
+	// nil unless read-through is enabled
+	readThrough *readThrough
+	// nil unless MEMORY_LIMIT_BYTES is set
+	memory *memoryGuard
+	// keys under these prefixes keep their first write
+	fwwPrefixes []string
+	// bytes of patch bodies applied at once, per class of sender
+	peerAdmission   *admission
+	clientAdmission *admission
+	// answer reads of absent keys with 200 {"found":false} instead of 404
+	missingAsBody bool
+	// exchange digests before values in gossip rounds
+	metadataFirst bool
+	// nil unless GOSSIP_QUOTA_OPS_PER_SEC is set
+	originQuota *originQuota
+	// capture wall-clock time on user writes for tie-breaks
+	wallClockTieBreak bool
+	conflicts         conflictStats
+	maintenance       maintenance
+	syncSupervisor    syncSupervisor
+
+	// maps every key to its canonical form before it is stored or looked up, nil means identity
+	normalizeKey func(string) string
+
+	views map[*MaterializedView]struct{}
+	// nil unless a consistent cut is being exported
+	cut *cut
+
+	// split batches longer than this when applying, 0 applies them whole
+	applyChunk int
+	lockStats  lockStats
 }
 
 func NewLWWMap(nodeID string, replicas []string) *LWWMap {
-	return &LWWMap{
-		store:    make(map[string]Data),
-		clock:    Clock(0),
-		nodeID:   nodeID,
-		replicas: replicas,
+	return NewLWWMapWithTransport(nodeID, replicas, NewHTTPTransport(nodeID))
+}
+
+func NewLWWMapWithTransport(nodeID string, replicas []string, transport Transport) *LWWMap {
+	return NewLWWMapWithStore(nodeID, replicas, transport, NewMemoryStore())
+}
+
+// NewLWWMapWithStore builds a map over the given store, which may already
+// hold entries
+func NewLWWMapWithStore(nodeID string, replicas []string, transport Transport, store Store) *LWWMap {
+	m := &LWWMap{
+		store: store,
+		// starts at 1 so no stored entry has timestamp 0, which CAS uses
+		// to mean "must not exist"
+		clock:     Clock(1),
+		nodeID:    nodeID,
+		replicas:  replicas,
+		transport: transport,
+
+		quarantine: newQuarantine(5, time.Minute, 5*time.Minute),
+
+		scheduler:      newSyncScheduler(500*time.Millisecond, 10*time.Second),
+		syncSupervisor: syncSupervisor{stall: 2 * time.Minute, backoff: time.Second, maxBackoff: time.Minute},
+		peers:          newPeerSelector(replicas),
+
+		largeValueBytes: 1 << 20,
+		peerAdmission:   newAdmission(64 << 20),
+		clientAdmission: newAdmission(16 << 20),
+		changed:         make(chan struct{}, 1),
+
+		hotKeys: newHotKeys(),
+
+		frozenKeys:     make(map[string]bool),
+		frozenPrefixes: make(map[string]bool),
+
+		virtualKeys: make(map[string]func() string),
+
+		views: make(map[*MaterializedView]struct{}),
 	}
+	// a store with entries already in it must not be outrun by local stamps
+	for key, data := range store.All() {
+		m.clock = max(m.clock, data.Timestamp+1)
+		m.toggleDigest(key, data)
+	}
+	m.registerBuiltinVirtualKeys()
+	return m
 }
 
+// Apply merges a replicated batch. Write interceptors only see it when
+// interceptReplicated is set.
 func (m *LWWMap) Apply(operations []Patch) {
+	if m.interceptReplicated {
+		if err := m.ApplyClient(operations); err != nil {
+			log.Printf("Node %s dropped replicated batch: %v", m.nodeID, err)
+		}
+		return
+	}
+	if _, err := m.apply(operations); err != nil {
+		log.Printf("Node %s dropped replicated batch: %v", m.nodeID, err)
+	}
+}
+
+// ApplyClient merges a client batch, running it through the write
+// interceptors first
+func (m *LWWMap) ApplyClient(operations []Patch) error {
+	operations, err := m.intercept(operations)
+	if err != nil {
+		return err
+	}
+	return m.applyIntercepted(operations)
+}
+
+// intercept maps keys to their stored form and runs the write interceptors
+// over operations
+func (m *LWWMap) intercept(operations []Patch) ([]Patch, error) {
+	if len(m.interceptors) == 0 {
+		return operations, nil
+	}
+
+	// interceptors see the key that will be stored
+	normalized := make([]Patch, len(operations))
+	for i, op := range operations {
+		op.Key = m.key(op.Key)
+		normalized[i] = op
+	}
+	return m.beforeApply(normalized)
+}
+
+// applyIntercepted merges operations that already went through intercept
+func (m *LWWMap) applyIntercepted(operations []Patch) error {
+	results, err := m.apply(operations)
+	if err != nil {
+		return err
+	}
+	m.afterApply(operations, results)
+	return nil
+}
+
+// apply merges operations into the store. Several user or several
+// replicated operations on one key are first collapsed to the one that wins
+// among them, so replicated outcomes don't depend on their order in the
+// batch while user writes keep the order the client gave them; the others
+// report not applied.
+func (m *LWWMap) apply(operations []Patch) ([]OpResult, error) {
+	kept, winners := m.collapse(operations)
+	if len(kept) == len(operations) {
+		return m.applyChunks(operations)
+	}
+
+	keptResults, err := m.applyChunks(kept)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]OpResult, len(operations))
+	for i, winner := range winners {
+		results[i] = keptResults[winner.kept]
+		results[i].Applied = results[i].Applied && winner.op == i
+	}
+	return results, nil
+}
+
+// applyChunks applies batches longer than applyChunk chunk by chunk,
+// releasing the lock in between so reads aren't starved; each chunk is then
+// atomic on its own rather than the whole batch, and a rejected chunk
+// leaves the ones before it applied.
+func (m *LWWMap) applyChunks(operations []Patch) ([]OpResult, error) {
+	if m.applyChunk <= 0 || len(operations) <= m.applyChunk {
+		return m.applyBatch(operations)
+	}
+
+	results := make([]OpResult, 0, len(operations))
+	for start := 0; start < len(operations); start += m.applyChunk {
+		end := min(start+m.applyChunk, len(operations))
+		chunk, err := m.applyBatch(operations[start:end])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, chunk...)
+	}
+	return results, nil
+}
+
+// applyBatch merges operations under one lock. Afterwards the clock is past
+// every op timestamp in the batch, regardless of which ops were accepted, so
+// a user op stamped later never ties with one replicated in the same batch.
+// A user op on a claimed first-writer-wins key rejects the batch; checking
+// under the same lock means two concurrent first writers can't both pass.
+func (m *LWWMap) applyBatch(operations []Patch) ([]OpResult, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for _, op := range operations {
-		timestamp := m.clock
-		// user request
+	if len(operations) == 0 {
+		return nil, nil
+	}
+	if key, claimed := m.claimed(operations); claimed {
+		return nil, &WriteRejection{Status: http.StatusConflict, Reason: "Key " + key + " is already claimed"}
+	}
+
+	locked := time.Now()
+	defer func() {
+		held := time.Since(locked)
+		m.lockStats.record(held)
+		if held >= slowApply {
+			log.Printf("Node %s held the store lock for %v applying %d operations", m.nodeID, held, len(operations))
+		}
+	}()
+
+	return m.merge(operations), nil
+}
+
+// merge is applyBatch without the locking, m.mu must be held
+func (m *LWWMap) merge(operations []Patch) []OpResult {
+	results := make([]OpResult, len(operations))
+	next := m.clock
+	for i, op := range operations {
+		op.Key = m.key(op.Key)
+		m.hotKeys.record(op.Key)
+
 		if op.Timestamp < 0 {
-			timestamp = m.clock
+			// user request, stamped from the local clock so it beats every
+			// entry seen so far and later user ops in the batch beat it
+			op.Timestamp = next
+			op.Node = m.nodeID
+			next++
+			if m.wallClockTieBreak {
+				op.Wall = time.Now().UnixNano()
+			}
 		}
+		// replicated ops keep their timestamp, so replicas receiving the
+		// same write store the same entry and converge
 		value := Data{
 			Value:     op.Value,
-			Timestamp: timestamp, // timestamp less than 0 -- user request
+			Timestamp: op.Timestamp,
+			Wall:      op.Wall,
+			Node:      op.Node,
 		}
-		existing, exists := m.store[op.Key]
-		if !exists || existing.Timestamp < op.Timestamp {
-			m.clock++
-			m.store[op.Key] = value
+		existing, exists := m.store.Get(op.Key)
+		won := !exists || m.wins(op.Key, op, existing)
+		if exists && op.Timestamp == existing.Timestamp {
+			m.recordConflict(op, existing, won)
+		}
+		if won {
+			value.Version = nextVersion(op, existing)
+			m.set(op.Key, value)
+			results[i].Applied = true
 			log.Printf("Node %s applied operation %v", m.nodeID, op)
-		} else if existing.Timestamp == op.Timestamp {
-			// tie-breaker
-			if op.Value > existing.Value {
-				m.store[op.Key] = value
-				log.Printf("Node %s applied operation %v", m.nodeID, op)
-				m.clock++
-			}
 		}
-		m.clock = max(m.clock, op.Timestamp)
+		stored, _ := m.store.Get(op.Key)
+		results[i].Timestamp = stored.Timestamp
+		next = max(next, op.Timestamp+1)
+	}
+	m.clock = next
+	return results
+}
+
+func (m *LWWMap) key(key string) string {
+	if m.normalizeKey == nil {
+		return key
+	}
+	return m.normalizeKey(key)
+}
+
+// set stores value under key, m.mu must be held
+func (m *LWWMap) set(key string, value Data) {
+	existing, exists := m.store.Get(key)
+	if m.values != nil {
+		if exists {
+			m.values.release(existing.Value)
+		}
+		value.Value = m.values.intern(value.Value)
+	}
+	if m.index != nil {
+		if exists {
+			m.index.remove(existing.Value, key)
+		}
+		m.index.add(value.Value, key)
+	}
+	if exists {
+		m.toggleDigest(key, existing)
+		if m.cut != nil {
+			m.cut.retain(key, existing)
+		}
+	}
+	m.toggleDigest(key, value)
+	m.store.Set(key, value)
+	for view := range m.views {
+		view.notify(key, value)
+	}
+
+	m.changes++
+	select {
+	case m.changed <- struct{}{}:
+	default:
 	}
 }
 
@@ -92,17 +434,95 @@ func (m *LWWMap) Patch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("New Patch request")
+	peer := m.peer(r)
+	if peer != "" && m.quarantine.quarantined(peer) {
+		http.Error(w, "Node "+peer+" is quarantined", http.StatusForbidden)
+		return
+	}
+	pool := m.clientAdmission
+	if peer != "" {
+		pool = m.peerAdmission
+	}
+	release, admitted := m.admitBody(w, r, pool)
+	if !admitted {
+		return
+	}
+	defer release()
+
+	body := io.Reader(r.Body)
+	if m.strictUTF8 {
+		// the JSON decoder would silently replace invalid bytes, so check first
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+		if !utf8.Valid(raw) {
+			if peer != "" {
+				log.Printf("Node %s received gossip batch with invalid UTF-8 from node %s", m.nodeID, peer)
+				m.gossipFailure(peer)
+				http.Error(w, "Request body is not valid UTF-8", http.StatusUnprocessableEntity)
+				return
+			}
+			http.Error(w, "Request body is not valid UTF-8", http.StatusBadRequest)
+			return
+		}
+		body = bytes.NewReader(raw)
+	}
 	var operations []Patch
-	if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+	if err := json.NewDecoder(body).Decode(&operations); err != nil {
+		if status := bodyErrorStatus(err); status != http.StatusBadRequest {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if peer != "" {
+			log.Printf("Node %s received malformed gossip batch from node %s: %v", m.nodeID, peer, err)
+			m.gossipFailure(peer)
+			// a 4xx tells the sender to drop the batch rather than resend it
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	log.Printf("Received %d operations for patch", len(operations))
-	m.Apply(operations)
+	if peer != "" {
+		if m.originQuota != nil && !m.originQuota.allow(peer, len(operations)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Node "+peer+" is over its gossip quota", http.StatusTooManyRequests)
+			return
+		}
+		if m.recorder != nil {
+			m.recorder.record(peer, operations)
+		}
+		m.Apply(operations)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	write, admitted := m.admitClientWrite(w, r, operations, true)
+	if !admitted {
+		return
+	}
+	if err := m.applyIntercepted(write.operations); err != nil {
+		writeRejected(w, err)
+		return
+	}
+	write.finish(w)
 	w.WriteHeader(http.StatusOK)
 }
 
+// bodyErrorStatus is 413 when reading a request body failed for passing its
+// size limit and 400 otherwise
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
 func (m *LWWMap) Get(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
@@ -111,24 +531,122 @@ func (m *LWWMap) Get(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("New Get request")
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	var key Get
 	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	if data, exists := m.store[key.Key]; exists {
+	var data Data
+	var virtual, exists bool
+	var err error
+	peer := m.peer(r) != ""
+	if peer {
+		// peers get the stored entry as is
+		data, exists = m.lookup(key.Key)
+	} else {
+		var mode, consistency string
+		if consistency, err = m.sessionConsistency(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if mode, err = m.prepareRead(r.Context(), key.Key, consistency); err != nil {
+			http.Error(w, err.Error(), consistencyStatus(err))
+			return
+		}
+		w.Header().Set(consistencyHeader, mode)
+		data, virtual, exists, err = m.read(r.Context(), key.Key)
+	}
+	if err != nil {
+		log.Printf("Failed to read key %s: %v", key.Key, err)
+		http.Error(w, "Failed to read key", http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		if virtual {
+			w.Header().Set(virtualHeader, "true")
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(data)
 		return // good ending
 	}
 
+	if !peer && m.missingKeyBody(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Missing{Found: false})
+		return
+	}
 	http.Error(w, "Key not found", http.StatusNotFound)
 }
 
+// Missing is the body served for an absent key when the client opts out of 404
+type Missing struct {
+	Found bool `json:"found"`
+}
+
+// missingKeyBody reports whether an absent key is answered with 200 and a
+// Missing body. The deployment default can be overridden per request with
+// Accept: application/json; missing=body (or missing=404).
+func (m *LWWMap) missingKeyBody(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accept)
+		if err != nil || mediaType != "application/json" {
+			continue
+		}
+		switch params["missing"] {
+		case "body":
+			return true
+		case "404":
+			return false
+		}
+	}
+	return m.missingAsBody
+}
+
+func (m *LWWMap) GetRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+
+	consistency, err := m.sessionConsistency(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode, err := m.prepareRead(r.Context(), key, consistency)
+	if err != nil {
+		http.Error(w, err.Error(), consistencyStatus(err))
+		return
+	}
+	w.Header().Set(consistencyHeader, mode)
+
+	// strings are immutable, so the value is streamed after read unlocks
+	data, virtual, exists, err := m.read(r.Context(), key)
+	if err != nil {
+		log.Printf("Failed to read key %s: %v", key, err)
+		http.Error(w, "Failed to read key", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	if virtual {
+		w.Header().Set(virtualHeader, "true")
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data.Value)))
+	// hiding WriteTo makes the copy go through a small buffer, strings.Reader
+	// would convert the whole value to one []byte for the writer
+	if _, err := io.Copy(w, struct{ io.Reader }{strings.NewReader(data.Value)}); err != nil {
+		log.Printf("Failed to stream key %s: %v", key, err)
+	}
+}
+
 // func (m *LWWMap) broadcast(operations []Patch) {
 // 	for _, replica := range m.replicas {
 // 		go func(replica string) {
@@ -155,14 +673,14 @@ func (m *LWWMap) selectRandomKeys(k int) []string {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if k <= 0 || len(m.store) == 0 {
+	if k <= 0 || m.store.Len() == 0 {
 		return []string{}
 	}
 
-	k = min(k, len(m.store))
+	k = min(k, m.store.Len())
 
-	keys := make([]string, 0, len(m.store))
-	for key := range m.store {
+	keys := make([]string, 0, m.store.Len())
+	for key := range m.store.All() {
 		keys = append(keys, key)
 	}
 
@@ -177,40 +695,204 @@ func (m *LWWMap) selectRandomKeys(k int) []string {
 	return keys[:k]
 }
 
-func (m *LWWMap) sync() {
-	for {
-		time.Sleep(time.Duration(rand.Intn(3)) * time.Second)
-		log.Println("Syncing with replicas")
-		log.Printf("Current state: %v", m.store)
-		selectedKeys := m.selectRandomKeys(5)
-		operations := make([]Patch, len(selectedKeys))
-
-		for i, key := range selectedKeys {
-			data := m.store[key]
-			operations[i] = Patch{
-				Key:       key,
-				Value:     data.Value,
-				Timestamp: data.Timestamp,
-			}
+// send paces the batch through limiter before handing it to the transport
+func (m *LWWMap) send(ctx context.Context, limiter *tokenBucket, replica string, operations []Patch) error {
+	if limiter != nil {
+		if err := limiter.wait(ctx, opsSize(operations)); err != nil {
+			return err
+		}
+	}
+	if len(operations) == 0 {
+		return m.transport.SendOps(ctx, replica, operations)
+	}
+	last := operations[len(operations)-1]
+	for attempt := 0; ; attempt++ {
+		m.peers.sent(replica, last)
+		err := m.transport.SendOps(ctx, replica, operations)
+		m.peers.acked(replica, last, err)
+		var throttled *ThrottledError
+		if !errors.As(err, &throttled) || attempt == 2 {
+			return err
 		}
+		// the peer is busy, not broken: wait as asked and try again
+		log.Printf("Node %s throttled by %s, retrying in %v", m.nodeID, replica, throttled.RetryAfter)
+		select {
+		case <-time.After(throttled.RetryAfter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
 
-		replica := m.replicas[rand.Intn(len(m.replicas))]
-		url := "http://" + replica + "/patch"
-		data, _ := json.Marshal(operations)
-		resp, err := http.Post(url, "application/json", bytes.NewReader(data))
-		log.Printf("Sending %d operations to %s", len(operations), replica)
-		if err != nil {
-			log.Printf("Failed to send operations to %s: %v", replica, err)
-			continue
+// keyspaceHash returns an order-independent hash of the store along with the
+// number of entries, so equal stores hash equally on every node
+func (m *LWWMap) keyspaceHash() (string, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sum [sha256.Size]byte
+	for _, bucket := range m.buckets {
+		for i := range sum {
+			sum[i] ^= bucket[i]
+		}
+	}
+	return hex.EncodeToString(sum[:]), m.store.Len()
+}
+
+func (m *LWWMap) logKeyspaceHash(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.logHash()
+	}
+}
+
+func (m *LWWMap) logHash() {
+	hash, count := m.keyspaceHash()
+	log.Printf("Node %s keyspace hash %s over %d keys", m.nodeID, hash, count)
+}
+
+// syncRound runs one gossip round and returns the change count it saw,
+// which the next round compares against to tell whether it is productive
+func (m *LWWMap) syncRound(ctx context.Context, lastChanges int) int {
+	m.mu.Lock()
+	changes := m.changes
+	m.mu.Unlock()
+	m.scheduler.observe(changes != lastChanges)
+	lastChanges = changes
+
+	log.Printf("Syncing with replicas, interval %v", m.scheduler.current())
+	selectedKeys := m.selectRandomKeys(5)
+	operations := make([]Patch, len(selectedKeys))
+
+	// entries are copied under the lock so a concurrent apply is never
+	// seen half-written
+	m.mu.Lock()
+	for i, key := range selectedKeys {
+		data, _ := m.store.Get(key)
+		operations[i] = data.patch(key)
+	}
+	m.mu.Unlock()
+
+	m.probeQuarantined(ctx)
+	replicas := m.quarantine.exchangeable(m.replicas)
+	if len(replicas) == 0 {
+		log.Printf("Node %s has no replica outside quarantine to sync with", m.nodeID)
+		return lastChanges
+	}
+	replica := m.peers.next(replicas)
+	if m.metadataFirst {
+		operations = m.wanted(ctx, replica, operations)
+	}
+	log.Printf("Sending %d operations to %s", len(operations), replica)
+	var err error
+	for _, batch := range splitBatch(operations, len(operations), m.largeValueBytes) {
+		if err = m.send(ctx, m.steadyLimit, replica, batch); err != nil {
+			break
+		}
+	}
+	var rejected *RejectedError
+	var throttled *ThrottledError
+	switch {
+	case err == nil:
+		log.Printf("Successfully sent %d operations to %s", len(operations), replica)
+		if err := m.reconcile(ctx, replica); err != nil {
+			log.Printf("Failed to reconcile with %s: %v", replica, err)
 		}
-		resp.Body.Close()
-		if resp.StatusCode == http.StatusOK {
-			log.Printf("Successfully sent %d operations to %s", len(operations), replica)
+	case errors.As(err, &throttled):
+		// the operations are resent in a later round, just back off
+		log.Printf("Replica %s is still busy, backing off for %v", replica, throttled.RetryAfter)
+		m.scheduler.observe(false)
+	case errors.As(err, &rejected):
+		// the peer can't use this batch, resending it won't help
+		log.Printf("Replica %s rejected %d operations with status %d, dropping batch", replica, len(operations), rejected.Status)
+	default:
+		log.Printf("Failed to send operations to %s: %v", replica, err)
+	}
+	return lastChanges
+}
+
+// routes mounts every endpoint under prefix, which is empty or starts with a
+// slash and has none at the end
+func (m *LWWMap) routes(prefix string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+"/patch", m.Patch)
+	mux.HandleFunc(prefix+"/casBatch", m.CASBatch)
+	mux.HandleFunc(prefix+"/getKey", m.Get)
+	mux.HandleFunc(prefix+"/getRaw", m.GetRaw)
+	mux.HandleFunc(prefix+"/hash", m.Hash)
+	mux.HandleFunc(prefix+"/converge", m.Converge)
+	mux.HandleFunc(prefix+"/verify", m.Verify)
+	mux.HandleFunc(prefix+"/cut", m.Cut)
+	mux.HandleFunc(prefix+"/export", m.Export)
+	mux.HandleFunc(prefix+"/buckets", m.Buckets)
+	mux.HandleFunc(prefix+"/digest", m.Digest)
+	mux.HandleFunc(prefix+"/reconcile", m.Reconcile)
+	mux.HandleFunc(prefix+"/hotkeys", m.HotKeys)
+	mux.HandleFunc(prefix+"/byValue", m.ByValue)
+	mux.HandleFunc(prefix+"/lag", m.Lag)
+	mux.HandleFunc(prefix+"/sync/status", m.SyncStatus)
+	mux.HandleFunc(prefix+"/peers", m.Peers)
+	mux.HandleFunc(prefix+"/stats", m.Stats)
+	mux.HandleFunc(prefix+"/freeze", m.Freeze)
+	mux.HandleFunc(prefix+"/unfreeze", m.Unfreeze)
+	mux.HandleFunc(prefix+"/policy", m.Policy)
+	mux.HandleFunc(prefix+"/type", m.Type)
+	mux.HandleFunc(prefix+"/maintenance", m.Maintenance)
+	mux.HandleFunc(prefix+"/quarantine", m.Quarantine)
+	mux.HandleFunc(prefix+"/unquarantine", m.Unquarantine)
+	return mux
+}
+
+// durationEnv parses a duration from the environment, falling back when unset
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return duration
+}
+
+// newServer bounds how long a client may hold a connection. WriteTimeout
+// leaves room for /converge, which waits 30s by default.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: durationEnv("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       durationEnv("HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      durationEnv("HTTP_WRITE_TIMEOUT", time.Minute),
+		IdleTimeout:       durationEnv("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+	}
+}
+
+// bandwidthLimit builds a token bucket from a rate and burst environment
+// variable pair, returning nil when no rate is set
+func bandwidthLimit(rateVar, burstVar string) *tokenBucket {
+	if os.Getenv(rateVar) == "" {
+		return nil
+	}
+	rate, err := strconv.ParseFloat(os.Getenv(rateVar), 64)
+	if err != nil || rate <= 0 {
+		log.Fatalf("Invalid %s: %q", rateVar, os.Getenv(rateVar))
+	}
+	burst := rate
+	if os.Getenv(burstVar) != "" {
+		if burst, err = strconv.ParseFloat(os.Getenv(burstVar), 64); err != nil || burst <= 0 {
+			log.Fatalf("Invalid %s: %q", burstVar, os.Getenv(burstVar))
 		}
 	}
+	return newTokenBucket(rate, burst)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+
 	nodeID := os.Getenv("NODE_ID")
 	if nodeID == "" {
 		log.Fatal("NODE_ID environment variable is not set")
@@ -225,15 +907,259 @@ func main() {
 
 	log.Printf("Node %s is starting with replicas %v", nodeID, replicas)
 
-	lwwMap := NewLWWMap(nodeID, replicas)
+	transport := NewHTTPTransport(nodeID)
+	transport.secret = os.Getenv("PEER_SECRET")
+	if transport.secret == "" {
+		log.Printf("Node %s has no PEER_SECRET: any client can pass as a peer with X-Node-ID and skip client checks such as freeze", nodeID)
+	}
+	if prefix := strings.Trim(os.Getenv("ROUTE_PREFIX"), "/"); prefix != "" {
+		transport.routePrefix = "/" + prefix
+	}
+	if limit := os.Getenv("PEER_RESPONSE_MAX_BYTES"); limit != "" {
+		var err error
+		if transport.maxResponseBytes, err = strconv.ParseInt(limit, 10, 64); err != nil || transport.maxResponseBytes <= 0 {
+			log.Fatalf("Invalid PEER_RESPONSE_MAX_BYTES: %q", limit)
+		}
+	}
+
+	var lwwMap *LWWMap
+	store := NewMemoryStore()
+	if path := os.Getenv("STORE_FILE"); path != "" {
+		if os.Getenv("DRY_RUN_MIGRATIONS") == "true" {
+			plan, err := MigrationPlan(path)
+			if err != nil {
+				log.Fatalf("Error reading store %s: %v", path, err)
+			}
+			log.Printf("Store %s needs %d migrations", path, len(plan))
+			for _, step := range plan {
+				log.Printf("Would migrate store %s %s", path, step)
+			}
+			return
+		}
+		var err error
+		if store, err = OpenFileStore(path); err != nil {
+			log.Fatalf("Error opening store %s: %v", path, err)
+		}
+		log.Printf("Node %s opened store %s with %d keys", nodeID, path, store.Len())
+		store.(*fileStore).compress = os.Getenv("STORE_COMPRESSION") == "true"
+	}
+
+	var udpConn *net.UDPConn
+	if port := os.Getenv("UDP_GOSSIP_PORT"); port != "" {
+		udpPort, err := strconv.Atoi(port)
+		if err != nil || udpPort <= 0 || udpPort > 65535 {
+			log.Fatalf("Invalid UDP_GOSSIP_PORT: %q", port)
+		}
+		if udpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: udpPort}); err != nil {
+			log.Fatalf("Error listening on UDP port %d: %v", udpPort, err)
+		}
+		udp, err := NewUDPTransport(transport, udpPort)
+		if err != nil {
+			log.Fatalf("Error starting UDP transport: %v", err)
+		}
+		lwwMap = NewLWWMapWithStore(nodeID, replicas, udp, store)
+	} else {
+		lwwMap = NewLWWMapWithStore(nodeID, replicas, transport, store)
+	}
+
+	lwwMap.peerSecret = transport.secret
+
+	switch normalization := os.Getenv("KEY_NORMALIZATION"); normalization {
+	case "", "none":
+	case "lower":
+		lwwMap.normalizeKey = strings.ToLower
+	default:
+		log.Fatalf("Unknown KEY_NORMALIZATION %q", normalization)
+	}
+
+	if threshold := os.Getenv("QUARANTINE_THRESHOLD"); threshold != "" {
+		var err error
+		if lwwMap.quarantine.threshold, err = strconv.Atoi(threshold); err != nil || lwwMap.quarantine.threshold <= 0 {
+			log.Fatalf("Invalid QUARANTINE_THRESHOLD: %q", threshold)
+		}
+	}
+	lwwMap.quarantine.window = durationEnv("QUARANTINE_WINDOW", lwwMap.quarantine.window)
+	lwwMap.quarantine.duration = durationEnv("QUARANTINE_DURATION", lwwMap.quarantine.duration)
+	if passes := os.Getenv("QUARANTINE_PROBE_PASSES"); passes != "" {
+		var err error
+		if lwwMap.quarantine.passes, err = strconv.Atoi(passes); err != nil || lwwMap.quarantine.passes <= 0 {
+			log.Fatalf("Invalid QUARANTINE_PROBE_PASSES: %q", passes)
+		}
+	}
+
+	if os.Getenv("DEDUP_VALUES") == "true" {
+		// a file store reads values back from disk, there is no copy in
+		// memory to share
+		if os.Getenv("STORE_FILE") != "" {
+			log.Fatal("DEDUP_VALUES cannot be combined with STORE_FILE")
+		}
+		lwwMap.values = newValuePool()
+	}
+
+	if os.Getenv("VALUE_INDEX") == "true" {
+		lwwMap.enableValueIndex()
+	}
+
+	if path := os.Getenv("RECORD_FILE"); path != "" {
+		maxBytes := int64(64 << 20)
+		if limit := os.Getenv("RECORD_MAX_BYTES"); limit != "" {
+			var err error
+			if maxBytes, err = strconv.ParseInt(limit, 10, 64); err != nil {
+				log.Fatalf("Invalid RECORD_MAX_BYTES: %v", err)
+			}
+		}
+		recorder, err := newRecorder(path, maxBytes, durationEnv("RECORD_FLUSH_INTERVAL", time.Second))
+		if err != nil {
+			log.Fatalf("Failed to open recording %s: %v", path, err)
+		}
+		lwwMap.recorder = recorder
+	}
+
+	// replaying the store file is off unless asked for, it blocks writes
+	if verifyInterval := durationEnv("VERIFY_INTERVAL", 0); verifyInterval > 0 {
+		go lwwMap.verifyPeriodically(verifyInterval)
+	}
+
+	if hashInterval := durationEnv("HASH_LOG_INTERVAL", time.Minute); hashInterval > 0 {
+		go lwwMap.logKeyspaceHash(hashInterval)
+	}
+
+	minInterval := durationEnv("SYNC_MIN_INTERVAL", lwwMap.scheduler.min)
+	maxInterval := durationEnv("SYNC_MAX_INTERVAL", lwwMap.scheduler.max)
+	if minInterval <= 0 || maxInterval < minInterval {
+		log.Fatalf("Invalid sync interval bounds %v..%v", minInterval, maxInterval)
+	}
+	lwwMap.scheduler = newSyncScheduler(minInterval, maxInterval)
+
+	// a round may idle for up to the longest wait before it does anything
+	lwwMap.syncSupervisor.stall = durationEnv("SYNC_STALL_TIMEOUT", lwwMap.syncSupervisor.stall)
+	if longest := lwwMap.scheduler.longestWait(); lwwMap.syncSupervisor.stall <= longest {
+		log.Fatalf("SYNC_STALL_TIMEOUT %v must exceed the longest sync wait %v (1.5x SYNC_MIN_INTERVAL plus SYNC_MAX_INTERVAL)", lwwMap.syncSupervisor.stall, longest)
+	}
+
+	// validation has to see the plaintext, so it goes before encryption
+	if os.Getenv("STRICT_UTF8") == "true" {
+		lwwMap.strictUTF8 = true
+		lwwMap.AddWriteInterceptor(RequireUTF8{})
+	}
+
+	if key := os.Getenv("VALUE_ENCRYPTION_KEY"); key != "" {
+		// the index holds stored values, which would be ciphertext that no
+		// plaintext lookup ever matches
+		if lwwMap.index != nil {
+			log.Fatal("VALUE_INDEX cannot be combined with VALUE_ENCRYPTION_KEY")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			log.Fatalf("Invalid VALUE_ENCRYPTION_KEY: %v", err)
+		}
+		encrypt, err := NewEncryptValues(decoded)
+		if err != nil {
+			log.Fatalf("Invalid VALUE_ENCRYPTION_KEY: %v", err)
+		}
+		lwwMap.AddWriteInterceptor(encrypt)
+		lwwMap.AddReadInterceptor(encrypt)
+	}
+	lwwMap.interceptReplicated = os.Getenv("INTERCEPT_REPLICATED") == "true"
+
+	if chunk := os.Getenv("APPLY_CHUNK_SIZE"); chunk != "" {
+		var err error
+		if lwwMap.applyChunk, err = strconv.Atoi(chunk); err != nil || lwwMap.applyChunk < 0 {
+			log.Fatalf("Invalid APPLY_CHUNK_SIZE: %q", chunk)
+		}
+	}
+
+	if limit := os.Getenv("LARGE_VALUE_BYTES"); limit != "" {
+		var err error
+		if lwwMap.largeValueBytes, err = strconv.Atoi(limit); err != nil || lwwMap.largeValueBytes <= 0 {
+			log.Fatalf("Invalid LARGE_VALUE_BYTES: %q", limit)
+		}
+	}
+
+	if limit := os.Getenv("GOSSIP_QUOTA_OPS_PER_SEC"); limit != "" {
+		rate, err := strconv.ParseFloat(limit, 64)
+		if err != nil || rate <= 0 {
+			log.Fatalf("Invalid GOSSIP_QUOTA_OPS_PER_SEC: %q", limit)
+		}
+		// a catch-up push sends up to 500 operations per batch
+		burst := max(500, rate)
+		if value := os.Getenv("GOSSIP_QUOTA_BURST"); value != "" {
+			if burst, err = strconv.ParseFloat(value, 64); err != nil || burst < 500 {
+				log.Fatalf("Invalid GOSSIP_QUOTA_BURST, must be at least 500: %q", value)
+			}
+		}
+		lwwMap.originQuota = newOriginQuota(rate, burst)
+	}
+
+	if limit := os.Getenv("ADMISSION_PEER_BYTES"); limit != "" {
+		var err error
+		if lwwMap.peerAdmission.capacity, err = strconv.ParseInt(limit, 10, 64); err != nil || lwwMap.peerAdmission.capacity <= 0 {
+			log.Fatalf("Invalid ADMISSION_PEER_BYTES: %q", limit)
+		}
+	}
+	if limit := os.Getenv("ADMISSION_CLIENT_BYTES"); limit != "" {
+		var err error
+		if lwwMap.clientAdmission.capacity, err = strconv.ParseInt(limit, 10, 64); err != nil || lwwMap.clientAdmission.capacity <= 0 {
+			log.Fatalf("Invalid ADMISSION_CLIENT_BYTES: %q", limit)
+		}
+	}
+
+	lwwMap.steadyLimit = bandwidthLimit("THROTTLE_BYTES_PER_SEC", "THROTTLE_BURST_BYTES")
+	lwwMap.catchUpLimit = bandwidthLimit("CATCHUP_BYTES_PER_SEC", "CATCHUP_BURST_BYTES")
+
+	if os.Getenv("READ_THROUGH") == "true" {
+		rate := 50.0
+		if limit := os.Getenv("READ_THROUGH_RATE"); limit != "" {
+			var err error
+			if rate, err = strconv.ParseFloat(limit, 64); err != nil || rate <= 0 {
+				log.Fatalf("Invalid READ_THROUGH_RATE: %q", limit)
+			}
+		}
+		lwwMap.readThrough = newReadThrough(0.5, rate)
+		go lwwMap.watchSparse(10 * time.Second)
+	}
+
+	lwwMap.metadataFirst = os.Getenv("GOSSIP_METADATA_FIRST") == "true"
+	lwwMap.wallClockTieBreak = os.Getenv("WALL_CLOCK_TIEBREAK") == "true"
+
+	if rate := os.Getenv("CONFLICT_SAMPLE_RATE"); rate != "" {
+		var err error
+		if lwwMap.conflicts.sampleRate, err = strconv.Atoi(rate); err != nil || lwwMap.conflicts.sampleRate < 0 {
+			log.Fatalf("Invalid CONFLICT_SAMPLE_RATE: %q", rate)
+		}
+	}
+
+	switch missing := os.Getenv("MISSING_KEY"); missing {
+	case "", "404":
+	case "body":
+		lwwMap.missingAsBody = true
+	default:
+		log.Fatalf("Unknown MISSING_KEY response %q", missing)
+	}
 
-	http.HandleFunc("/patch", lwwMap.Patch)
-	http.HandleFunc("/getKey", lwwMap.Get)
+	if prefixes := os.Getenv("FWW_PREFIXES"); prefixes != "" {
+		for _, prefix := range strings.Split(prefixes, ",") {
+			lwwMap.fwwPrefixes = append(lwwMap.fwwPrefixes, lwwMap.key(prefix))
+		}
+	}
 
-	go lwwMap.sync()
+	if limit := os.Getenv("MEMORY_LIMIT_BYTES"); limit != "" {
+		heapLimit, err := strconv.ParseUint(limit, 10, 64)
+		if err != nil || heapLimit == 0 {
+			log.Fatalf("Invalid MEMORY_LIMIT_BYTES: %q", limit)
+		}
+		lwwMap.memory = newMemoryGuard(heapLimit)
+		go lwwMap.watchMemory(time.Second)
+	}
+
+	if udpConn != nil {
+		go lwwMap.serveUDP(udpConn)
+	}
+	go lwwMap.sync(context.Background())
 
+	server := newServer(":8080", lwwMap.routes(transport.routePrefix))
 	log.Printf("Node %s is starting on port 8080", nodeID)
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
 }
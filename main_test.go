@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// every apply logs, which drowns test output
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newCluster builds n nodes named n0, n1, ... that reach each other over one
+// MemoryTransport, each with a store from newStore
+func newCluster(n int, newStore func() Store) ([]*LWWMap, *MemoryTransport) {
+	transport := NewMemoryTransport()
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("n%d", i)
+	}
+	nodes := make([]*LWWMap, n)
+	for i, name := range names {
+		replicas := []string{}
+		for _, other := range names {
+			if other != name {
+				replicas = append(replicas, other)
+			}
+		}
+		nodes[i] = NewLWWMapWithStore(name, replicas, transport, newStore())
+		transport.Register(name, nodes[i])
+	}
+	return nodes, transport
+}
+
+func write(key, value string) []Patch {
+	return []Patch{{Key: key, Value: value, Timestamp: -1}}
+}
+
+func mustGet(t testing.TB, m *LWWMap, key string) Data {
+	t.Helper()
+	data, exists := m.lookup(key)
+	if !exists {
+		t.Fatalf("node %s has no key %q", m.nodeID, key)
+	}
+	return data
+}
+
+func itoa(c Clock) string {
+	return strconv.Itoa(int(c))
+}
+
+// loggedHash returns the hash m logs for its keyspace
+func loggedHash(t *testing.T, m *LWWMap) string {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(io.Discard)
+	m.logHash()
+	fields := strings.Fields(buf.String())
+	i := slices.Index(fields, "hash")
+	if i < 0 || i+1 >= len(fields) {
+		t.Fatalf("no hash in %q", buf.String())
+	}
+	return fields[i+1]
+}
+
+func TestHashLogShowsDivergence(t *testing.T) {
+	nodes, _ := newCluster(3, NewMemoryStore)
+	nodes[0].ApplyClient(write("a", "1"))
+	nodes[0].ApplyClient(write("b", "2"))
+	nodes[1].Apply(nodes[0].snapshot())
+	nodes[2].Apply(nodes[0].snapshot())
+	nodes[2].ApplyClient(write("b", "3"))
+
+	if loggedHash(t, nodes[0]) != loggedHash(t, nodes[1]) {
+		t.Fatal("identical nodes logged different hashes")
+	}
+	if loggedHash(t, nodes[0]) == loggedHash(t, nodes[2]) {
+		t.Fatal("a divergent node logged the same hash")
+	}
+}
+
+// streamCounter is a ResponseWriter that keeps only the size of what is
+// written to it
+type streamCounter struct {
+	header http.Header
+	status int
+	bytes  int
+}
+
+func (s *streamCounter) Header() http.Header         { return s.header }
+func (s *streamCounter) WriteHeader(status int)      { s.status = status }
+func (s *streamCounter) Write(p []byte) (int, error) { s.bytes += len(p); return len(p), nil }
+
+func TestGetRawStreamsWithoutCopying(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	value := strings.Repeat("0123456789", 800_000)
+	m.ApplyClient(write("big", value))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	w := &streamCounter{header: http.Header{}, status: http.StatusOK}
+	m.GetRaw(w, httptest.NewRequest(http.MethodGet, "/getRaw?key=big", nil))
+	runtime.ReadMemStats(&after)
+
+	if w.status != http.StatusOK || w.bytes != len(value) {
+		t.Fatalf("got status %d and %d bytes, want %d", w.status, w.bytes, len(value))
+	}
+	if w.header.Get("Content-Length") != strconv.Itoa(len(value)) {
+		t.Fatalf("got Content-Length %q", w.header.Get("Content-Length"))
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(len(value))/8 {
+		t.Fatalf("streaming %d bytes allocated %d", len(value), allocated)
+	}
+}
+
+func TestNormalizedKeysCollide(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	for _, node := range nodes {
+		node.normalizeKey = strings.ToLower
+	}
+	n0, n1 := nodes[0], nodes[1]
+	n0.ApplyClient(write("Foo", "1"))
+	n0.ApplyClient(write("FOO", "2"))
+
+	if _, keys := n0.keyspaceHash(); keys != 1 {
+		t.Fatalf("got %d keys, want Foo and FOO in one entry", keys)
+	}
+	if data := mustGet(t, n0, "foo"); data.Value != "2" {
+		t.Fatalf("got %q for foo, want the later write", data.Value)
+	}
+
+	// gossip carries the normalized key, and so do the hashes
+	n1.Apply([]Patch{{Key: "fOO", Value: "2", Timestamp: mustGet(t, n0, "foo").Timestamp, Node: "n0"}})
+	if writesHash(n1) != writesHash(n0) {
+		t.Fatal("a differently cased replicated key hashed differently")
+	}
+}
+
+func TestKeysKeepTheirCaseByDefault(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.ApplyClient(write("Foo", "1"))
+	m.ApplyClient(write("foo", "2"))
+	if _, keys := m.keyspaceHash(); keys != 2 {
+		t.Fatalf("got %d keys, want Foo and foo apart", keys)
+	}
+	if data := mustGet(t, m, "Foo"); data.Value != "1" {
+		t.Fatalf("got %q for Foo, want 1", data.Value)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	server := newServer(":0", nil)
+	if server.ReadHeaderTimeout != 5*time.Second || server.ReadTimeout != 30*time.Second ||
+		server.WriteTimeout != time.Minute || server.IdleTimeout != 2*time.Minute {
+		t.Fatalf("got defaults %v %v %v %v", server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	t.Setenv("HTTP_READ_HEADER_TIMEOUT", "50ms")
+	t.Setenv("HTTP_IDLE_TIMEOUT", "1s")
+	server = newServer(":0", nil)
+	if server.ReadHeaderTimeout != 50*time.Millisecond || server.IdleTimeout != time.Second {
+		t.Fatalf("got %v and %v, want the overrides", server.ReadHeaderTimeout, server.IdleTimeout)
+	}
+	if server.ReadTimeout != 30*time.Second {
+		t.Fatalf("got read timeout %v, want the default kept", server.ReadTimeout)
+	}
+}
+
+func TestSlowHeadersAreCutOff(t *testing.T) {
+	t.Setenv("HTTP_READ_HEADER_TIMEOUT", "50ms")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer("", http.NotFoundHandler())
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// never finish the headers
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	io.ReadAll(conn)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("a client stalling its headers held the connection for %v", elapsed)
+	}
+}
+
+func getMissing(m *LWWMap, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/getKey", strings.NewReader(`{"key":"missing"}`))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	m.Get(w, r)
+	return w
+}
+
+func TestMissingKeyResponses(t *testing.T) {
+	for _, test := range []struct {
+		deployment bool
+		accept     string
+		body       bool
+	}{
+		{false, "", false},
+		{false, "application/json; missing=body", true},
+		{false, "text/plain, application/json;missing=body", true},
+		{true, "", true},
+		{true, "application/json; missing=404", false},
+		{true, "application/json", true},
+	} {
+		m := NewLWWMap("n0", nil)
+		m.missingAsBody = test.deployment
+		w := getMissing(m, test.accept)
+		switch {
+		case test.body && (w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"found":false}`):
+			t.Fatalf("default body=%t, Accept %q: got %d %q, want 200 with found false", test.deployment, test.accept, w.Code, w.Body)
+		case !test.body && w.Code != http.StatusNotFound:
+			t.Fatalf("default body=%t, Accept %q: got %d, want 404", test.deployment, test.accept, w.Code)
+		}
+	}
+}
+
+func TestPeersAlwaysGet404ForMissingKeys(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.missingAsBody = true
+	r := httptest.NewRequest(http.MethodPost, "/getKey", strings.NewReader(`{"key":"missing"}`))
+	r.Header.Set(nodeHeader, "n1")
+	w := httptest.NewRecorder()
+	m.Get(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("a peer got status %d, want 404 so FetchKey reads it as absent", w.Code)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// maxQueuedWrites bounds the client batches held during maintenance
+const maxQueuedWrites = 10000
+
+var errQueueFull = errors.New("maintenance write queue is full")
+
+// maintenance holds client writes instead of applying them while enabled.
+// Reads and gossip carry on. The queue lives in memory only, so writes
+// queued when the process dies are lost.
+type maintenance struct {
+	mu      sync.Mutex
+	enabled bool
+	queue   [][]Patch
+}
+
+func (q *maintenance) active() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.enabled
+}
+
+// enqueue holds operations if maintenance is on and reports whether it did.
+// They have already been through the write interceptors.
+func (q *maintenance) enqueue(operations []Patch) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.enabled {
+		return false, nil
+	}
+	if len(q.queue) >= maxQueuedWrites {
+		return true, errQueueFull
+	}
+	q.queue = append(q.queue, operations)
+	return true, nil
+}
+
+type Maintenance struct {
+	Enabled bool `json:"enabled"`
+	Queued  int  `json:"queued"`
+}
+
+// Maintenance reports the mode on GET and switches it on POST. Leaving
+// maintenance applies the queued batches in arrival order before new client
+// writes are accepted again.
+func (m *LWWMap) Maintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var mode Maintenance
+		if err := json.NewDecoder(r.Body).Decode(&mode); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		m.setMaintenance(mode.Enabled)
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.maintenance.mu.Lock()
+	mode := Maintenance{Enabled: m.maintenance.enabled, Queued: len(m.maintenance.queue)}
+	m.maintenance.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mode)
+}
+
+func (m *LWWMap) setMaintenance(enabled bool) {
+	q := &m.maintenance
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.enabled == enabled {
+		return
+	}
+	if enabled {
+		q.enabled = true
+		log.Printf("Node %s entered maintenance, queueing client writes", m.nodeID)
+		return
+	}
+
+	// the lock stays held while draining so new writes queue behind it
+	for _, operations := range q.queue {
+		if err := m.applyIntercepted(operations); err != nil {
+			log.Printf("Node %s dropped queued write after maintenance: %v", m.nodeID, err)
+		}
+	}
+	log.Printf("Node %s left maintenance, applied %d queued writes", m.nodeID, len(q.queue))
+	q.queue = nil
+	q.enabled = false
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// storeSchema is the schema this build writes store files in. A file of an
+// older schema is upgraded on open by the migrations from its schema on; a
+// newer one is refused, since this build would misread it.
+const storeSchema = 3
+
+// migratingSuffix names the file a migration writes before it replaces the
+// store, so a migration cut short leaves the store as it was
+const migratingSuffix = ".migrating"
+
+// entries between progress lines while migrating a large store
+const migrationProgress = 100000
+
+// migration upgrades a store file from schema from to from+1 one entry line
+// at a time
+type migration struct {
+	from     int
+	describe string
+	// line rewrites an entry line of schema from, without its newline, as
+	// the line of schema from+1, with it
+	line func(line []byte) ([]byte, error)
+}
+
+var migrations = []migration{
+	{
+		// files written before stores had headers and entries versions
+		from:     0,
+		describe: "add the schema header and count every stored entry as version 1",
+		line: func(line []byte) ([]byte, error) {
+			var entry fileEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				return nil, err
+			}
+			entry.Data.Version = max(entry.Data.Version, 1)
+			encoded, err := json.Marshal(entry)
+			return append(encoded, '\n'), err
+		},
+	},
+	{
+		from:     1,
+		describe: "checksum every entry",
+		line: func(line []byte) ([]byte, error) {
+			var entry fileEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				return nil, err
+			}
+			return encodeEntry(entry, false)
+		},
+	},
+	{
+		// the lines stay as they are, the bump only keeps builds that can't
+		// read compressed entries away from files that may have them
+		from:     2,
+		describe: "allow compressed entries",
+		line: func(line []byte) ([]byte, error) {
+			return append(line, '\n'), nil
+		},
+	},
+}
+
+type schemaLine struct {
+	Schema int `json:"schema"`
+}
+
+func schemaHeader(schema int) []byte {
+	header, _ := json.Marshal(schemaLine{Schema: schema})
+	return append(header, '\n')
+}
+
+// readSchema returns the schema of the store file at path, which is the
+// current one for a file that doesn't exist or is empty. Files from before
+// headers have schema 0.
+func readSchema(path string) (int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return storeSchema, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if errors.Is(err, io.EOF) && len(line) == 0 {
+		return storeSchema, nil
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if !bytes.HasPrefix(line, []byte(`{"schema":`)) {
+		return 0, nil
+	}
+	var header schemaLine
+	if err := json.Unmarshal(line, &header); err != nil {
+		return 0, fmt.Errorf("corrupt schema header: %w", err)
+	}
+	return header.Schema, nil
+}
+
+// pendingMigrations returns the migrations the store at path needs, in the
+// order they run
+func pendingMigrations(path string) ([]migration, error) {
+	schema, err := readSchema(path)
+	if err != nil {
+		return nil, err
+	}
+	if schema > storeSchema {
+		return nil, fmt.Errorf("store %s has schema %d, this build only reads up to %d", path, schema, storeSchema)
+	}
+	return migrations[schema:], nil
+}
+
+// MigrationPlan describes what opening the store at path would migrate,
+// without touching it
+func MigrationPlan(path string) ([]string, error) {
+	pending, err := pendingMigrations(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := make([]string, len(pending))
+	for i, step := range pending {
+		plan[i] = fmt.Sprintf("schema %d to %d: %s", step.from, step.from+1, step.describe)
+	}
+	return plan, nil
+}
+
+// migrateStore upgrades the store at path to storeSchema, one schema at a
+// time. Each step is written beside the store and renamed over it, so a
+// crash leaves the store at some schema a later open resumes from.
+func migrateStore(path string) error {
+	// a migration cut short is started over
+	if err := os.Remove(path + migratingSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	pending, err := pendingMigrations(path)
+	if err != nil {
+		return err
+	}
+	for _, step := range pending {
+		log.Printf("Migrating store %s from schema %d to %d: %s", path, step.from, step.from+1, step.describe)
+		if err := migrateStep(path, step); err != nil {
+			return fmt.Errorf("migrating store %s from schema %d: %w", path, step.from, err)
+		}
+	}
+	return nil
+}
+
+func migrateStep(path string, step migration) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.Create(path + migratingSuffix)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	reader := bufio.NewReader(source)
+	if step.from > 0 {
+		if _, err := reader.ReadBytes('\n'); err != nil {
+			return err
+		}
+	}
+	writer := bufio.NewWriter(target)
+	writer.Write(schemaHeader(step.from + 1))
+	entries := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// a torn last line is dropped, as opening the store would
+			break
+		}
+		if err != nil {
+			return err
+		}
+		migrated, err := step.line(bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", entries+1, err)
+		}
+		if _, err := writer.Write(migrated); err != nil {
+			return err
+		}
+		if entries++; entries%migrationProgress == 0 {
+			log.Printf("Migrated %d entries of store %s", entries, path)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	// unlike regular writes, the rename must not outrun the data it points to
+	if err := target.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(target.Name(), path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	log.Printf("Migrated %d entries of store %s to schema %d", entries, path, step.from+1)
+	return nil
+}
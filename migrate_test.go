@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// fixture copies the store file name from testdata into a fresh directory
+func fixture(t *testing.T, name string) string {
+	t.Helper()
+	contents, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "store")
+	if err := os.WriteFile(path, contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStoresOfEverySchemaMigrate(t *testing.T) {
+	for _, test := range []struct {
+		fixture string
+		// versions of a and b after migrating
+		versions [2]uint64
+	}{
+		{"store-schema0", [2]uint64{1, 1}},
+		{"store-schema1", [2]uint64{2, 4}},
+		{"store-schema2", [2]uint64{2, 4}},
+	} {
+		t.Run(test.fixture, func(t *testing.T) {
+			path := fixture(t, test.fixture)
+			store, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.(*fileStore).file.Close()
+
+			if store.Len() != 2 {
+				t.Fatalf("got %d keys, want 2", store.Len())
+			}
+			a, _ := store.Get("a")
+			b, _ := store.Get("b")
+			if a.Value != "3" || a.Timestamp != 3 || a.Node != "n0" || b.Wall != 7 {
+				t.Fatalf("got a %+v and b %+v", a, b)
+			}
+			if versions := [2]uint64{a.Version, b.Version}; versions != test.versions {
+				t.Fatalf("got versions %v, want %v", versions, test.versions)
+			}
+			if schema, _ := readSchema(path); schema != storeSchema {
+				t.Fatalf("store left at schema %d", schema)
+			}
+
+			// the migrated store takes writes and reopens as is
+			store.Set("c", Data{Value: "4", Timestamp: 4, Version: 1})
+			store.(*fileStore).file.Close()
+			reopened, err := OpenFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.(*fileStore).file.Close()
+			if c, _ := reopened.Get("c"); reopened.Len() != 3 || c.Value != "4" {
+				t.Fatalf("got %d keys and c %+v after reopening", reopened.Len(), c)
+			}
+		})
+	}
+}
+
+func TestNewerStoreIsRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	os.WriteFile(path, schemaHeader(storeSchema+1), 0o644)
+	if _, err := OpenFileStore(path); err == nil {
+		t.Fatal("opened a store of a newer schema")
+	}
+	if _, err := MigrationPlan(path); err == nil {
+		t.Fatal("planned migrations for a store of a newer schema")
+	}
+}
+
+func TestMigrationPlanLeavesTheStoreAlone(t *testing.T) {
+	path := fixture(t, "store-schema0")
+	before, _ := os.ReadFile(path)
+
+	plan, err := MigrationPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != storeSchema {
+		t.Fatalf("got plan %q, want one step per schema", plan)
+	}
+	if after, _ := os.ReadFile(path); !slices.Equal(before, after) {
+		t.Fatal("planning changed the store")
+	}
+}
+
+func TestInterruptedMigrationStartsOver(t *testing.T) {
+	path := fixture(t, "store-schema1")
+	// a crash mid-migration leaves a partial file beside the store
+	os.WriteFile(path+migratingSuffix, []byte(`{"schema":2}`+"\n"+`0000`), 0o644)
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(*fileStore).file.Close()
+	if store.Len() != 2 {
+		t.Fatalf("got %d keys, want 2", store.Len())
+	}
+	if _, err := os.Stat(path + migratingSuffix); !os.IsNotExist(err) {
+		t.Fatal("the partial migration is still there")
+	}
+}
+
+func TestCorruptEntryIsDetected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("a", Data{Value: "hello", Timestamp: 1})
+	store.(*fileStore).file.Close()
+
+	contents, _ := os.ReadFile(path)
+	contents[len(contents)-20] ^= 1
+	os.WriteFile(path, contents, 0o644)
+	if _, err := OpenFileStore(path); err == nil {
+		t.Fatal("opened a store with a flipped bit")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMalformedGossipIsNotResent(t *testing.T) {
+	receiver := NewLWWMap("receiver", nil)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// the batch is corrupted on the way
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		receiver.Patch(w, r)
+	}))
+	defer server.Close()
+
+	replica := strings.TrimPrefix(server.URL, "http://")
+	sender := NewLWWMap("sender", []string{replica})
+	err := sender.send(context.Background(), nil, replica, write("k", "v"))
+
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.Status != http.StatusUnprocessableEntity {
+		t.Fatalf("send returned %v, want a rejection with status 422", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("sender made %d requests, want 1", n)
+	}
+}
+
+func TestChunkedPatchIsHeldToItsReservation(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.largeValueBytes = 64
+
+	body := `[{"key":"k","value":"` + strings.Repeat("x", 128) + `","timestamp":-1}]`
+	r := httptest.NewRequest(http.MethodPost, "/patch", strings.NewReader(body))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	m.Patch(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413", w.Code)
+	}
+	if _, exists := m.lookup("k"); exists {
+		t.Fatal("oversized body was applied")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// peerSelector picks the replica for each gossip round. Picks are random
+// until a replica has gone len(replicas) rounds without being contacted;
+// from then on the most starved overdue replica goes first. Every replica is
+// therefore contacted at least once every 2*len(replicas) rounds.
+type peerSelector struct {
+	mu       sync.Mutex
+	rounds   map[string]int
+	progress map[string]PeerProgress
+}
+
+func newPeerSelector(replicas []string) *peerSelector {
+	p := &peerSelector{
+		rounds:   make(map[string]int, len(replicas)),
+		progress: make(map[string]PeerProgress, len(replicas)),
+	}
+	for _, replica := range replicas {
+		p.rounds[replica] = 0
+	}
+	return p
+}
+
+func (p *peerSelector) next(replicas []string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, replica := range replicas {
+		p.rounds[replica]++
+	}
+
+	chosen := ""
+	for _, replica := range replicas {
+		if p.rounds[replica] > len(replicas) && (chosen == "" || p.rounds[replica] > p.rounds[chosen]) {
+			chosen = replica
+		}
+	}
+	if chosen == "" {
+		chosen = replicas[rand.Intn(len(replicas))]
+	}
+	p.rounds[chosen] = 0
+	return chosen
+}
+
+type SyncStatus struct {
+	// gossip rounds since each replica was last picked
+	RoundsSinceExchange map[string]int `json:"roundsSinceExchange"`
+	// every replica is picked at least once within this many rounds
+	RoundBound int `json:"roundBound"`
+	// quarantined node IDs and when probing for their release starts
+	Quarantined map[string]string `json:"quarantined"`
+}
+
+func (m *LWWMap) SyncStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.peers.mu.Lock()
+	status := SyncStatus{
+		RoundsSinceExchange: make(map[string]int, len(m.peers.rounds)),
+		RoundBound:          2 * len(m.replicas),
+	}
+	for replica, rounds := range m.peers.rounds {
+		status.RoundsSinceExchange[replica] = rounds
+	}
+	m.peers.mu.Unlock()
+	status.Quarantined = m.quarantine.status()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// PeerProgress is the last operation sent to a replica and the last one it
+// acknowledged. A LastSent that runs ahead of LastAcked for long means
+// replication to that replica is stuck.
+type PeerProgress struct {
+	LastSent    *Patch    `json:"lastSent,omitempty"`
+	LastSentAt  time.Time `json:"lastSentAt"`
+	LastAcked   *Patch    `json:"lastAcked,omitempty"`
+	LastAckedAt time.Time `json:"lastAckedAt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+func (p *peerSelector) sent(replica string, op Patch) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	progress := p.progress[replica]
+	progress.LastSent = &op
+	progress.LastSentAt = time.Now()
+	p.progress[replica] = progress
+}
+
+// acked records the outcome of sending op, a nil err being the ack
+func (p *peerSelector) acked(replica string, op Patch, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	progress := p.progress[replica]
+	if err != nil {
+		progress.LastError = err.Error()
+	} else {
+		progress.LastAcked = &op
+		progress.LastAckedAt = time.Now()
+		progress.LastError = ""
+	}
+	p.progress[replica] = progress
+}
+
+func (m *LWWMap) Peers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.peers.mu.Lock()
+	peers := make(map[string]PeerProgress, len(m.replicas))
+	for _, replica := range m.replicas {
+		peers[replica] = m.peers.progress[replica]
+	}
+	m.peers.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peers)
+}
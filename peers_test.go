@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestEveryPeerIsPickedWithinTheBound runs many rounds for several cluster
+// sizes and records the longest gap between two picks of the same replica
+func TestEveryPeerIsPickedWithinTheBound(t *testing.T) {
+	for _, n := range []int{1, 2, 5, 16} {
+		replicas := make([]string, n)
+		for i := range replicas {
+			replicas[i] = fmt.Sprintf("n%d", i)
+		}
+		p := newPeerSelector(replicas)
+		last := make(map[string]int, n)
+		longest := 0
+		for round := 1; round <= 100_000; round++ {
+			chosen := p.next(replicas)
+			longest = max(longest, round-last[chosen])
+			last[chosen] = round
+		}
+		for _, replica := range replicas {
+			longest = max(longest, 100_000-last[replica])
+		}
+		if longest > 2*n {
+			t.Fatalf("with %d replicas one went %d rounds unpicked, the bound is %d", n, longest, 2*n)
+		}
+	}
+}
+
+func TestSyncStatusReportsRoundsSinceExchange(t *testing.T) {
+	m := NewLWWMap("n0", []string{"n1", "n2", "n3"})
+	for range 10 {
+		m.peers.next(m.replicas)
+	}
+
+	w := httptest.NewRecorder()
+	m.SyncStatus(w, httptest.NewRequest(http.MethodGet, "/sync/status", nil))
+	var status SyncStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.RoundBound != 6 || len(status.RoundsSinceExchange) != 3 {
+		t.Fatalf("got %+v", status)
+	}
+	picked := 0
+	for replica, rounds := range status.RoundsSinceExchange {
+		if rounds > status.RoundBound {
+			t.Fatalf("%s went %d rounds unpicked", replica, rounds)
+		}
+		if rounds == 0 {
+			picked++
+		}
+	}
+	if picked != 1 {
+		t.Fatalf("got %d replicas picked in the last round", picked)
+	}
+}
+
+func peersOf(t *testing.T, m *LWWMap) map[string]PeerProgress {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Peers(w, httptest.NewRequest(http.MethodGet, "/peers", nil))
+	var peers map[string]PeerProgress
+	if err := json.NewDecoder(w.Body).Decode(&peers); err != nil {
+		t.Fatal(err)
+	}
+	return peers
+}
+
+func TestPeersShowLastSentAndAcked(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0 := nodes[0]
+	n0.replicas = append(n0.replicas, "gone")
+	ctx := context.Background()
+	first := Patch{Key: "a", Value: "1", Timestamp: 1, Node: "n0"}
+	last := Patch{Key: "b", Value: "2", Timestamp: 2, Node: "n0"}
+
+	if err := n0.send(ctx, nil, "n1", []Patch{first, last}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n0.send(ctx, nil, "gone", []Patch{first}); err == nil {
+		t.Fatal("sending to an unknown replica succeeded")
+	}
+
+	peers := peersOf(t, n0)
+	acked := peers["n1"]
+	if acked.LastSent == nil || *acked.LastSent != last || acked.LastAcked == nil || *acked.LastAcked != last {
+		t.Fatalf("got %+v for n1, want %+v sent and acked", acked, last)
+	}
+	if acked.LastSentAt.IsZero() || acked.LastAckedAt.IsZero() || acked.LastError != "" {
+		t.Fatalf("got %+v for n1", acked)
+	}
+	stuck := peers["gone"]
+	if stuck.LastSent == nil || *stuck.LastSent != first || stuck.LastAcked != nil || stuck.LastError == "" {
+		t.Fatalf("got %+v for the unreachable replica, want sent but not acked", stuck)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// memoryGuard samples the heap and reports pressure once it passes limit.
+// Pressure clears only after the heap drops below resume, so writes don't
+// flap on and off around the limit.
+type memoryGuard struct {
+	limit     uint64
+	resume    uint64
+	heap      atomic.Uint64
+	pressured atomic.Bool
+}
+
+func newMemoryGuard(limit uint64) *memoryGuard {
+	return &memoryGuard{limit: limit, resume: limit / 10 * 9}
+}
+
+func (g *memoryGuard) observe(heap uint64) (changed bool) {
+	g.heap.Store(heap)
+	switch {
+	case heap >= g.limit:
+		return !g.pressured.Swap(true)
+	case heap < g.resume:
+		return g.pressured.Swap(false)
+	}
+	return false
+}
+
+func (m *LWWMap) watchMemory(interval time.Duration) {
+	var stats runtime.MemStats
+	for range time.Tick(interval) {
+		runtime.ReadMemStats(&stats)
+		if m.memory.observe(stats.HeapAlloc) {
+			log.Printf("Node %s memory pressure=%t (heap %d bytes, limit %d)", m.nodeID, m.memory.pressured.Load(), stats.HeapAlloc, m.memory.limit)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// at most this many nodes have failures counted at once, so senders making
+// up node IDs can't grow the map without bound
+const maxTrackedFailures = 1024
+
+// quarantine tracks peers, by node ID, that keep sending malformed
+// replication data. Past threshold failures within window a peer is
+// quarantined: its gossip is refused and no exchange is started with it.
+// After duration it is probed each round and released once it passes
+// passes probes in a row.
+type quarantine struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	passes    int
+	failures  map[string][]time.Time
+	// when probing starts; zero means quarantined until cleared by hand
+	until  map[string]time.Time
+	passed map[string]int
+	// node ID behind each replica address, learned from its hash responses
+	nodes map[string]string
+}
+
+func newQuarantine(threshold int, window, duration time.Duration) *quarantine {
+	return &quarantine{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		passes:    3,
+		failures:  make(map[string][]time.Time),
+		until:     make(map[string]time.Time),
+		passed:    make(map[string]int),
+		nodes:     make(map[string]string),
+	}
+}
+
+// failure records a malformed payload from node and reports whether it just
+// tipped the node into quarantine
+func (q *quarantine) failure(node string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	if _, tracked := q.failures[node]; !tracked && len(q.failures) >= maxTrackedFailures {
+		q.expire(now)
+		if len(q.failures) >= maxTrackedFailures {
+			return false
+		}
+	}
+	recent := q.failures[node][:0]
+	for _, at := range q.failures[node] {
+		if now.Sub(at) < q.window {
+			recent = append(recent, at)
+		}
+	}
+	recent = append(recent, now)
+	q.failures[node] = recent
+
+	if _, exists := q.until[node]; exists || len(recent) < q.threshold {
+		return false
+	}
+	q.until[node] = now.Add(q.duration)
+	delete(q.failures, node)
+	return true
+}
+
+// expire forgets nodes whose failures are all older than window, q.mu must
+// be held
+func (q *quarantine) expire(now time.Time) {
+	for node, failures := range q.failures {
+		if now.Sub(failures[len(failures)-1]) >= q.window {
+			delete(q.failures, node)
+		}
+	}
+}
+
+// known reports whether some replica has answered as node
+func (q *quarantine) known(node string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, known := range q.nodes {
+		if known == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *quarantine) quarantined(node string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, exists := q.until[node]
+	return exists
+}
+
+// learn records that replica answers as node
+func (q *quarantine) learn(replica, node string) {
+	if node == "" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.nodes[replica] = node
+}
+
+// exchangeable returns the replicas whose node isn't quarantined. A replica
+// whose node ID isn't known yet is kept.
+func (q *quarantine) exchangeable(replicas []string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	kept := make([]string, 0, len(replicas))
+	for _, replica := range replicas {
+		if _, quarantined := q.until[q.nodes[replica]]; !quarantined {
+			kept = append(kept, replica)
+		}
+	}
+	return kept
+}
+
+// due returns the quarantined replicas whose probing has started
+func (q *quarantine) due(replicas []string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var due []string
+	for _, replica := range replicas {
+		until, exists := q.until[q.nodes[replica]]
+		if exists && !until.IsZero() && !now.Before(until) {
+			due = append(due, replica)
+		}
+	}
+	return due
+}
+
+// probed records a probe of replica and reports the node it released, if any
+func (q *quarantine) probed(replica string, passed bool) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	node := q.nodes[replica]
+	if _, exists := q.until[node]; !exists {
+		return "", false
+	}
+	if !passed {
+		delete(q.passed, node)
+		return "", false
+	}
+	q.passed[node]++
+	if q.passed[node] < q.passes {
+		return "", false
+	}
+	delete(q.passed, node)
+	delete(q.until, node)
+	return node, true
+}
+
+func (q *quarantine) set(node string, quarantined bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.failures, node)
+	delete(q.passed, node)
+	if quarantined {
+		q.until[node] = time.Time{}
+	} else {
+		delete(q.until, node)
+	}
+}
+
+// status maps each quarantined node to when probing for its release starts,
+// or "manual"
+func (q *quarantine) status() map[string]string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := make(map[string]string, len(q.until))
+	for node, until := range q.until {
+		if until.IsZero() {
+			status[node] = "manual"
+		} else {
+			status[node] = until.Format(time.RFC3339)
+		}
+	}
+	return status
+}
+
+type Quarantine struct {
+	Node string `json:"node"`
+}
+
+func (m *LWWMap) Quarantine(w http.ResponseWriter, r *http.Request) {
+	m.setQuarantined(w, r, true)
+}
+
+func (m *LWWMap) Unquarantine(w http.ResponseWriter, r *http.Request) {
+	m.setQuarantined(w, r, false)
+}
+
+func (m *LWWMap) setQuarantined(w http.ResponseWriter, r *http.Request, quarantined bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var target Quarantine
+	if err := json.NewDecoder(r.Body).Decode(&target); err != nil || target.Node == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	m.quarantine.set(target.Node, quarantined)
+	log.Printf("Node %s set quarantined=%t for node %s by hand", m.nodeID, quarantined, target.Node)
+	w.WriteHeader(http.StatusOK)
+}
+
+// gossipFailure counts a bad gossip payload from peer towards its quarantine.
+// Without a peer secret anyone can claim a node ID, so only the IDs replicas
+// answer as are counted there, or a client could quarantine a real peer.
+func (m *LWWMap) gossipFailure(peer string) {
+	if m.peerSecret == "" && !m.quarantine.known(peer) {
+		return
+	}
+	if m.quarantine.failure(peer) {
+		log.Printf("Node %s QUARANTINED node %s after repeated malformed gossip", m.nodeID, peer)
+	}
+}
+
+// probeQuarantined challenges every quarantined replica that is due and
+// lifts the quarantine of those that pass often enough in a row
+func (m *LWWMap) probeQuarantined(ctx context.Context) {
+	for _, replica := range m.quarantine.due(m.replicas) {
+		err := m.probe(ctx, replica)
+		if err != nil {
+			log.Printf("Node %s probe of quarantined replica %s failed: %v", m.nodeID, replica, err)
+		}
+		if node, released := m.quarantine.probed(replica, err == nil); released {
+			log.Printf("Node %s lifted the quarantine of node %s after %d passing probes", m.nodeID, node, m.quarantine.passes)
+		}
+	}
+}
+
+// probe checks that replica's bucket hashes XOR to the keyspace hash it
+// reports, which a peer with corrupted state or a corrupting link fails. A
+// write landing between the two calls fails a healthy peer too, which only
+// delays its release.
+func (m *LWWMap) probe(ctx context.Context, replica string) error {
+	hash, err := m.transport.KeyspaceHash(ctx, replica)
+	if err != nil {
+		return err
+	}
+	m.quarantine.learn(replica, hash.Node)
+	buckets, err := m.transport.BucketHashes(ctx, replica)
+	if err != nil {
+		return err
+	}
+	if len(buckets) != merkleBuckets {
+		return fmt.Errorf("got %d bucket hashes, want %d", len(buckets), merkleBuckets)
+	}
+
+	var sum [sha256.Size]byte
+	for _, bucket := range buckets {
+		raw, err := hex.DecodeString(bucket)
+		if err != nil || len(raw) != len(sum) {
+			return fmt.Errorf("malformed bucket hash %q", bucket)
+		}
+		for i := range sum {
+			sum[i] ^= raw[i]
+		}
+	}
+	if hex.EncodeToString(sum[:]) != hash.Hash {
+		return fmt.Errorf("bucket hashes don't add up to keyspace hash %s", hash.Hash)
+	}
+	return nil
+}
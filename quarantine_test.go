@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// corrupting delivers batches through the receiver's /patch handler and
+// corrupts a fraction of the payloads that come from node bad, both the
+// batches it sends and the bucket hashes it answers with
+type corrupting struct {
+	*MemoryTransport
+	self     string
+	bad      string
+	fraction float64
+	rng      *rand.Rand
+}
+
+func (c *corrupting) corrupt(from string) bool {
+	return from == c.bad && c.rng.Float64() < c.fraction
+}
+
+func (c *corrupting) SendOps(ctx context.Context, replica string, operations []Patch) error {
+	node, err := c.node(replica)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(operations)
+	if c.corrupt(c.self) {
+		body = body[:len(body)/2]
+	}
+	r := httptest.NewRequest(http.MethodPost, "/patch", bytes.NewReader(body))
+	r.Header.Set(nodeHeader, c.self)
+	w := httptest.NewRecorder()
+	node.Patch(w, r)
+	if w.Code != http.StatusOK {
+		return &RejectedError{Replica: replica, Status: w.Code}
+	}
+	return nil
+}
+
+func (c *corrupting) BucketHashes(ctx context.Context, replica string) ([]string, error) {
+	hashes, err := c.MemoryTransport.BucketHashes(ctx, replica)
+	if err == nil && c.corrupt(replica) {
+		hashes[0] = "ff" + hashes[0][2:]
+	}
+	return hashes, err
+}
+
+func TestCorruptingPeerIsQuarantinedUntilItPassesProbes(t *testing.T) {
+	nodes, memory := newCluster(3, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	rng := rand.New(rand.NewSource(1))
+	for _, node := range nodes {
+		node.transport = &corrupting{MemoryTransport: memory, self: node.nodeID, bad: "n1", fraction: 0.5, rng: rng}
+		node.ApplyClient(write("k"+node.nodeID, "v"))
+	}
+	n0.quarantine = newQuarantine(3, time.Minute, 0)
+	ctx := context.Background()
+
+	// n0 learns which node answers on each address
+	for _, replica := range n0.replicas {
+		n0.divergent(ctx, replica)
+	}
+	for range 20 {
+		n1.send(ctx, n1.steadyLimit, "n0", []Patch{{Key: "k", Value: "v", Timestamp: 1}})
+	}
+	if !n0.quarantine.quarantined("n1") {
+		t.Fatal("n1 was not quarantined")
+	}
+	if code := patchAs(n0, map[string]string{nodeHeader: "n1"}, `[]`); code != http.StatusForbidden {
+		t.Fatalf("gossip from n1 got status %d, want 403", code)
+	}
+	if replicas := n0.quarantine.exchangeable(n0.replicas); !slices.Equal(replicas, []string{"n2"}) {
+		t.Fatalf("n0 still exchanges with %v", replicas)
+	}
+
+	// every probe fails while n1 corrupts everything
+	n0.transport.(*corrupting).fraction = 1
+	for range 10 {
+		n0.probeQuarantined(ctx)
+	}
+	if !n0.quarantine.quarantined("n1") {
+		t.Fatal("n1 was released while still corrupting")
+	}
+
+	n0.transport.(*corrupting).fraction = 0
+	for range n0.quarantine.passes {
+		n0.probeQuarantined(ctx)
+	}
+	if n0.quarantine.quarantined("n1") {
+		t.Fatal("n1 is still quarantined after passing its probes")
+	}
+}
+
+func TestManualQuarantineIsNotProbed(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0 := nodes[0]
+	n0.quarantine.duration = 0
+	n0.divergent(context.Background(), "n1")
+	n0.quarantine.set("n1", true)
+
+	for range 2 * n0.quarantine.passes {
+		n0.probeQuarantined(context.Background())
+	}
+	if !n0.quarantine.quarantined("n1") {
+		t.Fatal("a manual quarantine was lifted by probes")
+	}
+}
+
+func TestOnlyKnownOrAuthenticatedPeersAreQuarantined(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0 := nodes[0]
+	n0.quarantine = newQuarantine(1, time.Minute, 0)
+
+	// without a secret, a made-up node ID is not counted
+	patchAs(n0, map[string]string{nodeHeader: "forged"}, `not json`)
+	if n0.quarantine.quarantined("forged") {
+		t.Fatal("an unknown node ID was quarantined")
+	}
+	n0.divergent(context.Background(), "n1")
+	patchAs(n0, map[string]string{nodeHeader: "n1"}, `not json`)
+	if !n0.quarantine.quarantined("n1") {
+		t.Fatal("a known node was not quarantined")
+	}
+
+	n0.peerSecret = "secret"
+	patchAs(n0, map[string]string{nodeHeader: "other", secretHeader: "secret"}, `not json`)
+	if !n0.quarantine.quarantined("other") {
+		t.Fatal("an authenticated node was not quarantined")
+	}
+}
+
+func TestFailuresAreCapped(t *testing.T) {
+	q := newQuarantine(2, time.Minute, 0)
+	for i := range maxTrackedFailures + 10 {
+		q.failure(fmt.Sprint(i))
+	}
+	if len(q.failures) != maxTrackedFailures {
+		t.Fatalf("tracking %d nodes, want the cap of %d", len(q.failures), maxTrackedFailures)
+	}
+
+	// once the tracked failures expire there is room again
+	q.window = 0
+	q.failure("late")
+	if _, tracked := q.failures["late"]; !tracked || len(q.failures) != 1 {
+		t.Fatalf("tracking %d nodes after expiry, want only the new one", len(q.failures))
+	}
+}
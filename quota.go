@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// originQuota limits the operations accepted by gossip from each origin
+// node, so a runaway node can't flood the cluster through us
+type originQuota struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	dropped map[string]int
+}
+
+func newOriginQuota(rate, burst float64) *originQuota {
+	return &originQuota{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+		dropped: make(map[string]int),
+	}
+}
+
+// allow takes n operations from origin's quota, counting them as dropped
+// if it is exhausted
+func (q *originQuota) allow(origin string, n int) bool {
+	q.mu.Lock()
+	bucket, exists := q.buckets[origin]
+	if !exists {
+		bucket = newTokenBucket(q.rate, q.burst)
+		q.buckets[origin] = bucket
+	}
+	q.mu.Unlock()
+
+	if bucket.allow(n) {
+		return true
+	}
+
+	q.mu.Lock()
+	q.dropped[origin] += n
+	dropped := q.dropped[origin]
+	q.mu.Unlock()
+	log.Printf("Node %s is over its gossip quota, dropped %d operations (%d in total)", origin, n, dropped)
+	return false
+}
+
+func (q *originQuota) drops() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	drops := make(map[string]int, len(q.dropped))
+	for origin, dropped := range q.dropped {
+		drops[origin] = dropped
+	}
+	return drops
+}
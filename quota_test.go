@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestGossipOverQuotaIsDropped(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	// refills too slowly to matter within the test
+	m.originQuota = newOriginQuota(0.001, 10)
+	batch := func(origin string, first int) string {
+		operations := make([]Patch, 5)
+		for i := range operations {
+			operations[i] = Patch{Key: origin + "/" + strconv.Itoa(first+i), Value: "v", Timestamp: 1, Node: origin}
+		}
+		body, _ := json.Marshal(operations)
+		return string(body)
+	}
+	from := func(origin string) map[string]string {
+		return map[string]string{nodeHeader: origin}
+	}
+
+	for i := range 2 {
+		if code := patchAs(m, from("n1"), batch("n1", i*5)); code != http.StatusOK {
+			t.Fatalf("batch %d within the quota got status %d", i, code)
+		}
+	}
+	if code := patchAs(m, from("n1"), batch("n1", 10)); code != http.StatusTooManyRequests {
+		t.Fatalf("batch over the quota got status %d, want 429", code)
+	}
+	if _, exists := m.lookup("n1/10"); exists {
+		t.Fatal("an operation over the quota was applied")
+	}
+	// other nodes have quotas of their own
+	if code := patchAs(m, from("n2"), batch("n2", 0)); code != http.StatusOK {
+		t.Fatalf("another node's gossip got status %d", code)
+	}
+	// client writes aren't gossip
+	if code := patchAs(m, nil, batch("client", 0)); code != http.StatusOK {
+		t.Fatalf("a client write got status %d", code)
+	}
+
+	if dropped := statsOf(t, m).GossipDropped; len(dropped) != 1 || dropped["n1"] != 5 {
+		t.Fatalf("got drops %v, want 5 from n1", dropped)
+	}
+}
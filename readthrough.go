@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// readThrough answers local misses from peers while the node is sparse, that
+// is while it holds far fewer keys than its fullest peer, typically right
+// after restarting empty. It switches itself off once the node catches up.
+type readThrough struct {
+	mu      sync.Mutex
+	sparse  bool
+	ratio   float64
+	timeout time.Duration
+	limiter *tokenBucket
+}
+
+func newReadThrough(ratio float64, rate float64) *readThrough {
+	return &readThrough{
+		sparse:  true,
+		ratio:   ratio,
+		timeout: 500 * time.Millisecond,
+		limiter: newTokenBucket(rate, rate),
+	}
+}
+
+func (rt *readThrough) active() bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.sparse
+}
+
+func (m *LWWMap) watchSparse(interval time.Duration) {
+	for {
+		m.checkSparse()
+		time.Sleep(interval)
+	}
+}
+
+func (m *LWWMap) checkSparse() {
+	m.mu.Lock()
+	local := m.store.Len()
+	m.mu.Unlock()
+	fullest := 0
+	for _, replica := range m.replicas {
+		// a hung peer must not leave the sparse flag stale
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		hash, err := m.transport.KeyspaceHash(ctx, replica)
+		cancel()
+		if err != nil {
+			continue
+		}
+		fullest = max(fullest, hash.Keys)
+	}
+	sparse := float64(local) < m.readThrough.ratio*float64(fullest)
+
+	m.readThrough.mu.Lock()
+	defer m.readThrough.mu.Unlock()
+	if sparse != m.readThrough.sparse {
+		log.Printf("Node %s holds %d keys against %d on its fullest peer, read-through sparse=%t", m.nodeID, local, fullest, sparse)
+	}
+	m.readThrough.sparse = sparse
+}
+
+// fetchFromPeers asks up to two random peers for key and merges a hit into
+// the store through the normal apply path
+func (m *LWWMap) fetchFromPeers(ctx context.Context, key string) bool {
+	if !m.readThrough.active() || len(m.replicas) == 0 || !m.readThrough.limiter.allow(1) {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.readThrough.timeout)
+	defer cancel()
+
+	for _, i := range rand.Perm(len(m.replicas))[:min(2, len(m.replicas))] {
+		data, found, err := m.transport.FetchKey(ctx, m.replicas[i], key)
+		if err != nil {
+			log.Printf("Read-through of %s from %s failed: %v", key, m.replicas[i], err)
+			continue
+		}
+		if found {
+			m.Apply([]Patch{data.patch(key)})
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestReadThroughCoversTheBootstrapWindow(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	for i := range 10 {
+		n0.ApplyClient(write(fmt.Sprintf("k%d", i), "v"))
+	}
+	n1.readThrough = newReadThrough(0.5, 1000)
+	read := func(key string) bool {
+		_, _, exists, _ := n1.read(context.Background(), key)
+		return exists
+	}
+
+	// bootstrap got through the first few keys only
+	n1.Apply(n0.snapshot()[:3])
+	n1.checkSparse()
+	if !n1.readThrough.active() {
+		t.Fatal("a node with 3 of 10 keys isn't sparse")
+	}
+	missing := ""
+	for i := range 10 {
+		if key := fmt.Sprintf("k%d", i); !hasKey(n1, key) {
+			missing = key
+			break
+		}
+	}
+	if !read(missing) {
+		t.Fatalf("%s wasn't read through from n0", missing)
+	}
+	if data := mustGet(t, n1, missing); data != mustGet(t, n0, missing) {
+		t.Fatalf("stored %+v, n0 has %+v", data, mustGet(t, n0, missing))
+	}
+	if read("nowhere") {
+		t.Fatal("a key no node has was found")
+	}
+
+	// caught up, a key written since is a plain miss until gossip brings it
+	n1.Apply(n0.snapshot())
+	n1.checkSparse()
+	if n1.readThrough.active() {
+		t.Fatal("a caught up node is still sparse")
+	}
+	n0.ApplyClient(write("late", "v"))
+	if read("late") {
+		t.Fatal("read-through stayed on after catching up")
+	}
+}
+
+func TestReadThroughIsRateLimited(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	n0.ApplyClient(write("a", "v"))
+	n0.ApplyClient(write("b", "v"))
+	n1.readThrough = newReadThrough(0.5, 1)
+
+	if !n1.fetchFromPeers(context.Background(), "a") {
+		t.Fatal("the first miss wasn't read through")
+	}
+	if n1.fetchFromPeers(context.Background(), "b") {
+		t.Fatal("a second miss within the same second went to the peers")
+	}
+}
+
+func hasKey(m *LWWMap, key string) bool {
+	_, exists := m.lookup(key)
+	return exists
+}
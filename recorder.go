@@ -0,0 +1,259 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type record struct {
+	Time       time.Time `json:"time"`
+	Peer       string    `json:"peer"`
+	Operations []Patch   `json:"operations"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// recorder writes incoming replication batches to a gzip-compressed file.
+// Each run starts a new file, moving the previous run's to path+".1", and
+// once the file reaches maxBytes it is rotated the same way, so at most two
+// files' worth of disk is used. A file therefore holds a single gzip member,
+// and one cut short by a crash still replays up to where it stopped.
+type recorder struct {
+	path     string
+	maxBytes int64
+	// how often buffered records are flushed to the file
+	flushInterval time.Duration
+	records       chan record
+	dropped       atomic.Int64
+	done          chan struct{}
+
+	file    *os.File
+	counter *countingWriter
+	gz      *gzip.Writer
+	dirty   bool
+}
+
+func newRecorder(path string, maxBytes int64, flushInterval time.Duration) (*recorder, error) {
+	r := &recorder{
+		path:          path,
+		maxBytes:      maxBytes,
+		flushInterval: flushInterval,
+		records:       make(chan record, 1024),
+		done:          make(chan struct{}),
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+// record queues a batch for writing, dropping it if the writer is behind so
+// the apply path never blocks
+func (r *recorder) record(peer string, operations []Patch) {
+	select {
+	case r.records <- record{Time: time.Now(), Peer: peer, Operations: operations}:
+	default:
+		if dropped := r.dropped.Add(1); dropped%100 == 1 {
+			log.Printf("Recorder queue full, %d batches dropped so far", dropped)
+		}
+	}
+}
+
+func (r *recorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec, ok := <-r.records:
+			if !ok {
+				if err := r.gz.Close(); err != nil {
+					log.Printf("Failed to close recording: %v", err)
+				}
+				r.file.Close()
+				return
+			}
+			if err := r.write(rec); err != nil {
+				log.Printf("Failed to record batch from %s: %v", rec.Peer, err)
+			}
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				log.Printf("Failed to flush recording: %v", err)
+			}
+		}
+	}
+}
+
+// close writes out what is queued and finishes the file
+func (r *recorder) close() {
+	close(r.records)
+	<-r.done
+}
+
+func (r *recorder) write(rec record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := r.gz.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	r.dirty = true
+	if r.counter.n >= r.maxBytes {
+		return r.rotate()
+	}
+	return nil
+}
+
+// flush pushes buffered records to the file, so a crash loses at most one
+// flush interval of them
+func (r *recorder) flush() error {
+	if !r.dirty {
+		return nil
+	}
+	r.dirty = false
+	if err := r.gz.Flush(); err != nil {
+		return err
+	}
+	if r.counter.n >= r.maxBytes {
+		return r.rotate()
+	}
+	return nil
+}
+
+func (r *recorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.counter = &countingWriter{w: file}
+	r.gz = gzip.NewWriter(r.counter)
+	r.dirty = false
+	return nil
+}
+
+func (r *recorder) rotate() error {
+	if err := r.gz.Close(); err != nil {
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// replay re-applies a recording, either into a fresh in-process node or by
+// sending the batches to a running one
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := flags.String("target", "", "replica to send the recorded batches to instead of replaying offline")
+	until := flags.String("until", "", "stop before the first batch recorded after this RFC 3339 time")
+	prefix := flags.String("prefix", "", "route prefix the target serves its endpoints under")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("usage: server replay [-target host:port] [-prefix path] [-until time] recording")
+	}
+
+	var stop time.Time
+	if *until != "" {
+		var err error
+		if stop, err = time.Parse(time.RFC3339, *until); err != nil {
+			log.Fatalf("Invalid -until time: %v", err)
+		}
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to open recording: %v", err)
+	}
+	defer file.Close()
+
+	lwwMap := NewLWWMapWithTransport("replay", nil, NewMemoryTransport())
+	transport := NewHTTPTransport("replay")
+	if trimmed := strings.Trim(*prefix, "/"); trimmed != "" {
+		transport.routePrefix = "/" + trimmed
+	}
+
+	apply := func(operations []Patch) error {
+		lwwMap.Apply(operations)
+		return nil
+	}
+	if *target != "" {
+		apply = func(operations []Patch) error {
+			return transport.SendOps(context.Background(), *target, operations)
+		}
+	}
+	batches, err := replayRecording(file, stop, apply)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *target != "" {
+		log.Printf("Sent %d batches to %s", batches, *target)
+		return
+	}
+	hash, count := lwwMap.keyspaceHash()
+	log.Printf("Replayed %d batches: keyspace hash %s over %d keys, clock %d", batches, hash, count, lwwMap.clock)
+}
+
+// replayRecording hands each batch in recording to apply and returns how
+// many it handed over. It stops before the first batch recorded after stop,
+// unless stop is zero.
+func replayRecording(recording io.Reader, stop time.Time, apply func([]Patch) error) (int, error) {
+	gz, err := gzip.NewReader(recording)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	batches := 0
+	decoder := json.NewDecoder(gz)
+	for {
+		var rec record
+		if err := decoder.Decode(&rec); errors.Is(err, io.EOF) {
+			break
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			// the recording of a live or crashed node has no gzip trailer
+			log.Printf("Recording ends after batch %d without a trailer", batches)
+			break
+		} else if err != nil {
+			return batches, fmt.Errorf("failed to decode batch %d: %w", batches+1, err)
+		}
+		if !stop.IsZero() && rec.Time.After(stop) {
+			break
+		}
+		if err := apply(rec.Operations); err != nil {
+			return batches, fmt.Errorf("failed to apply batch %d: %w", batches+1, err)
+		}
+		batches++
+	}
+	return batches, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replayed replays the recording at path into a fresh node and returns its
+// keyspace hash
+func replayed(t *testing.T, path string) (string, int) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	m := NewLWWMap("replay", nil)
+	batches, err := replayRecording(file, time.Time{}, func(operations []Patch) error {
+		m.Apply(operations)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := m.keyspaceHash()
+	return hash, batches
+}
+
+func TestRecordingReplaysToTheSameKeyspace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.gz")
+	r, err := newRecorder(path, 1<<30, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := NewLWWMap("n0", nil)
+	for i := range 50 {
+		batch := []Patch{{Key: fmt.Sprintf("k%d", i%7), Value: fmt.Sprint(i), Timestamp: Clock(i + 1), Node: "n1"}}
+		live.Apply(batch)
+		r.record("n1", batch)
+	}
+	r.close()
+
+	want, _ := live.keyspaceHash()
+	if hash, batches := replayed(t, path); hash != want || batches != 50 {
+		t.Fatalf("replayed %d batches to hash %s, want 50 batches and %s", batches, hash, want)
+	}
+}
+
+func TestRecorderStartsANewFileAfterACrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.gz")
+	crashed, err := newRecorder(path, 1<<30, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed.record("n1", []Patch{{Key: "old", Value: "v", Timestamp: 1}})
+	// wait for a flush, then leave the file without a trailer. Until then
+	// the file holds at most the 10 byte gzip header.
+	flushed := func() bool {
+		info, err := os.Stat(path)
+		if err != nil || info.Size() <= 10 {
+			return false
+		}
+		_, batches := replayed(t, path)
+		return batches == 1
+	}
+	for deadline := time.Now().Add(5 * time.Second); !flushed(); time.Sleep(crashed.flushInterval) {
+		if time.Now().After(deadline) {
+			t.Fatal("the recording wasn't flushed within 5s")
+		}
+	}
+	crashed.file.Close()
+
+	r, err := newRecorder(path, 1<<30, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.record("n1", []Patch{{Key: "new", Value: "v", Timestamp: 2}})
+	r.close()
+
+	if _, batches := replayed(t, path); batches != 1 {
+		t.Fatalf("this run's file replayed %d batches, want 1", batches)
+	}
+	if _, batches := replayed(t, path+".1"); batches != 1 {
+		t.Fatalf("the crashed run's file replayed %d batches, want 1", batches)
+	}
+}
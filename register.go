@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	lastWriteWins  = "last-write-wins"
+	firstWriteWins = "first-write-wins"
+)
+
+// firstWriterWins reports whether key is held in a first-writer-wins
+// register rather than the default last-writer-wins one, m.mu must be held
+func (m *LWWMap) firstWriterWins(key string) bool {
+	for _, prefix := range m.fwwPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// wins reports whether op replaces existing under key. Equal timestamps
+// fall back to the later wall clock, then the higher origin node ID, then
+// the higher value, for both register types so every replica picks the
+// same winner regardless of apply order. The same write wins over itself
+// only with a higher version.
+func (m *LWWMap) wins(key string, op Patch, existing Data) bool {
+	if op.Timestamp == existing.Timestamp {
+		if op.Wall != existing.Wall {
+			return op.Wall > existing.Wall
+		}
+		if op.Node != existing.Node {
+			return op.Node > existing.Node
+		}
+		if op.Value != existing.Value {
+			return op.Value > existing.Value
+		}
+		return op.Version > existing.Version
+	}
+	if m.firstWriterWins(key) {
+		return op.Timestamp < existing.Timestamp
+	}
+	return op.Timestamp > existing.Timestamp
+}
+
+// sameWrite reports whether op is the write existing holds
+func sameWrite(op Patch, existing Data) bool {
+	return op.Timestamp == existing.Timestamp && op.Wall == existing.Wall && op.Node == existing.Node && op.Value == existing.Value
+}
+
+// nextVersion is the version op stores once it has won over existing,
+// which is the zero Data for a new key. A different write counts one past
+// existing, or keeps its own count if that is higher; the same write only
+// brings a higher count from another replica.
+func nextVersion(op Patch, existing Data) uint64 {
+	if sameWrite(op, existing) {
+		return op.Version
+	}
+	return max(op.Version, existing.Version+1)
+}
+
+// claimed returns the first key a user op in operations writes that is
+// already taken in a first-writer-wins register, m.mu must be held. The
+// merge would ignore the write, so it is refused instead. Replicated ops
+// merge as usual, since an earlier first write has to replace a later one.
+func (m *LWWMap) claimed(operations []Patch) (string, bool) {
+	for _, op := range operations {
+		if op.Timestamp >= 0 {
+			continue
+		}
+		key := m.key(op.Key)
+		if _, exists := m.store.Get(key); exists && m.firstWriterWins(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+type Policy struct {
+	Prefix string `json:"prefix"`
+	Policy string `json:"policy"`
+}
+
+// Policy lists the first-write-wins prefixes on GET and sets the merge
+// policy of a prefix on POST. Changing the policy of a prefix that already
+// holds entries is refused, since replicas that merged them under the old
+// policy would no longer converge.
+func (m *LWWMap) Policy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		m.mu.Lock()
+		prefixes := slices.Clone(m.fwwPrefixes)
+		m.mu.Unlock()
+
+		policies := make([]Policy, len(prefixes))
+		for i, prefix := range prefixes {
+			policies[i] = Policy{Prefix: prefix, Policy: firstWriteWins}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policies)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var policy Policy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil || policy.Prefix == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if policy.Policy != lastWriteWins && policy.Policy != firstWriteWins {
+		http.Error(w, "Unknown policy "+policy.Policy, http.StatusBadRequest)
+		return
+	}
+	policy.Prefix = m.key(policy.Prefix)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index := slices.Index(m.fwwPrefixes, policy.Prefix)
+	if (index >= 0) == (policy.Policy == firstWriteWins) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	for key := range m.store.All() {
+		if strings.HasPrefix(key, policy.Prefix) {
+			http.Error(w, "Prefix "+policy.Prefix+" already holds entries", http.StatusConflict)
+			return
+		}
+	}
+	if index >= 0 {
+		m.fwwPrefixes = slices.Delete(m.fwwPrefixes, index, index+1)
+	} else {
+		m.fwwPrefixes = append(m.fwwPrefixes, policy.Prefix)
+	}
+	log.Printf("Node %s set policy %s for prefix %s", m.nodeID, policy.Policy, policy.Prefix)
+	w.WriteHeader(http.StatusOK)
+}
+
+// KeyType is the kind of register behind a key. Keys are never deleted, so
+// there is no tombstoned state to report.
+type KeyType struct {
+	Key    string `json:"key"`
+	Type   string `json:"type"`
+	Exists bool   `json:"exists"`
+}
+
+// Type serves /type?key=. The type follows from the key alone, so it is
+// reported for keys that don't exist yet too.
+func (m *LWWMap) Type(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyType := KeyType{Key: m.key(r.URL.Query().Get("key"))}
+	if keyType.Key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	if _, virtual := m.virtualKey(keyType.Key); virtual {
+		keyType.Type, keyType.Exists = "virtual", true
+	} else {
+		m.mu.Lock()
+		keyType.Type = "lww-register"
+		if m.firstWriterWins(keyType.Key) {
+			keyType.Type = "fww-register"
+		}
+		_, keyType.Exists = m.store.Get(keyType.Key)
+		m.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keyType)
+}
+
+// batchWinner records, for an operation, which operation of its batch won
+// its key: op indexes the batch, kept the collapsed batch
+type batchWinner struct {
+	op   int
+	kept int
+}
+
+// collapse keeps one user and one replicated operation per key, the one
+// that wins among them, each in its own position in the batch. A user and a
+// replicated operation on one key are both kept, since which wins depends on
+// the stamp the user operation gets from its position. winners maps every
+// operation of the batch to its group's winner.
+func (m *LWWMap) collapse(operations []Patch) (kept []Patch, winners []batchWinner) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type group struct {
+		key  string
+		user bool
+	}
+	groupOf := func(op Patch) group {
+		return group{key: m.key(op.Key), user: op.Timestamp < 0}
+	}
+	best := make(map[group]int, len(operations))
+	for i, op := range operations {
+		g := groupOf(op)
+		if winner, seen := best[g]; !seen || m.beatsInBatch(g.key, op, operations[winner]) {
+			best[g] = i
+		}
+	}
+	// the winners keep their batch order, which user stamps depend on
+	positions := make(map[group]int, len(best))
+	for i, op := range operations {
+		if g := groupOf(op); best[g] == i {
+			positions[g] = len(kept)
+			kept = append(kept, op)
+		}
+	}
+	winners = make([]batchWinner, len(operations))
+	for i, op := range operations {
+		g := groupOf(op)
+		winners[i] = batchWinner{op: best[g], kept: positions[g]}
+	}
+	return kept, winners
+}
+
+// beatsInBatch reports whether op wins over other, an earlier operation on
+// the same key and from the same origin in one batch, m.mu must be held.
+// User operations are stamped in batch order, so the later of two wins, as
+// the client ordered them; first-writer-wins keys keep the earliest instead.
+func (m *LWWMap) beatsInBatch(key string, op, other Patch) bool {
+	if op.Timestamp < 0 {
+		return !m.firstWriterWins(key)
+	}
+	return m.wins(key, op, other.data())
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEqualTimestampsBreakOnNode(t *testing.T) {
+	a := Patch{Key: "k", Value: "a", Timestamp: 5, Node: "n2"}
+	b := Patch{Key: "k", Value: "b", Timestamp: 5, Node: "n1"}
+
+	for _, order := range [][]Patch{{a, b}, {b, a}} {
+		m := NewLWWMap("n0", nil)
+		for _, op := range order {
+			m.Apply([]Patch{op})
+		}
+		if data := mustGet(t, m, "k"); data.Value != "a" || data.Node != "n2" {
+			t.Fatalf("applying %v left %+v, want the write from n2", order, data)
+		}
+	}
+}
+
+func TestLaterWallClockWinsATie(t *testing.T) {
+	later := Patch{Key: "k", Value: "later", Timestamp: 5, Wall: 2000, Node: "n1"}
+	earlier := Patch{Key: "k", Value: "earlier", Timestamp: 5, Wall: 1000, Node: "n2"}
+
+	for _, order := range [][]Patch{{later, earlier}, {earlier, later}} {
+		m := NewLWWMap("n0", nil)
+		for _, op := range order {
+			m.Apply([]Patch{op})
+		}
+		if data := mustGet(t, m, "k"); data.Value != "later" {
+			t.Fatalf("applying %v left %+v, want the later wall clock over the higher node", order, data)
+		}
+	}
+}
+
+func TestWallClockTieBreakAcrossNodes(t *testing.T) {
+	for _, wallClock := range []bool{false, true} {
+		nodes, _ := newCluster(2, NewMemoryStore)
+		n0, n1 := nodes[0], nodes[1]
+		for _, node := range nodes {
+			node.wallClockTieBreak = wallClock
+		}
+		// both clocks are fresh, so the writes tie on their timestamp
+		n1.ApplyClient(write("k", "from n1"))
+		time.Sleep(time.Millisecond)
+		n0.ApplyClient(write("k", "from n0"))
+		n0.Apply(n1.snapshot())
+		n1.Apply(n0.snapshot())
+
+		want := "from n1"
+		if wallClock {
+			want = "from n0"
+		}
+		for _, node := range nodes {
+			if data := mustGet(t, node, "k"); data.Value != want {
+				t.Fatalf("wall clock tie-break %t: node %s kept %q, want %q", wallClock, node.nodeID, data.Value, want)
+			}
+		}
+	}
+}
+
+func TestUserWritesAreStampedWithTheirNode(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.ApplyClient(write("k", "v"))
+	if data := mustGet(t, m, "k"); data.Node != "n0" {
+		t.Fatalf("stored %+v, want node n0", data)
+	}
+}
+
+func TestConcurrentFirstWritersGetOneWinner(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.fwwPrefixes = []string{"lock/"}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = m.ApplyClient(write("lock/a", string(rune('a'+i))))
+		}()
+	}
+	wg.Wait()
+
+	won := 0
+	for _, err := range errs {
+		var rejection *WriteRejection
+		switch {
+		case err == nil:
+			won++
+		case !errors.As(err, &rejection) || rejection.Status != http.StatusConflict:
+			t.Fatalf("got %v, want a 409 rejection", err)
+		}
+	}
+	if won != 1 {
+		t.Fatalf("%d writers won, want 1", won)
+	}
+}
+
+func TestClaimedKeyPatchIsConflict(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.fwwPrefixes = []string{"lock/"}
+	body := `[{"key":"lock/a","value":"v","timestamp":-1}]`
+
+	if code := patchAs(m, nil, body); code != http.StatusOK {
+		t.Fatalf("first write got status %d, want 200", code)
+	}
+	if code := patchAs(m, nil, body); code != http.StatusConflict {
+		t.Fatalf("second write got status %d, want 409", code)
+	}
+}
+
+func TestEarlierReplicatedWriteTakesClaimedKey(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.fwwPrefixes = []string{"lock/"}
+	m.Apply([]Patch{{Key: "lock/a", Value: "late", Timestamp: 9}})
+	m.Apply([]Patch{{Key: "lock/a", Value: "early", Timestamp: 4}})
+
+	if data := mustGet(t, m, "lock/a"); data.Value != "early" {
+		t.Fatalf("stored %+v, want the earlier write", data)
+	}
+}
+
+func TestUserBatchLastWriteWins(t *testing.T) {
+	for _, order := range [][2]string{{"a", "b"}, {"b", "a"}} {
+		m := NewLWWMap("n0", nil)
+		results, err := m.apply([]Patch{
+			{Key: "k", Value: order[0], Timestamp: -1},
+			{Key: "k", Value: order[1], Timestamp: -1},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := mustGet(t, m, "k"); data.Value != order[1] {
+			t.Fatalf("batch %v stored %q, want the later write", order, data.Value)
+		}
+		if results[0].Applied || !results[1].Applied {
+			t.Fatalf("batch %v reported %+v", order, results)
+		}
+	}
+}
+
+func TestUserBatchFirstWriteWinsOnClaimedPrefix(t *testing.T) {
+	for _, order := range [][2]string{{"a", "b"}, {"b", "a"}} {
+		m := NewLWWMap("n0", nil)
+		m.fwwPrefixes = []string{"lock/"}
+		m.ApplyClient([]Patch{
+			{Key: "lock/k", Value: order[0], Timestamp: -1},
+			{Key: "lock/k", Value: order[1], Timestamp: -1},
+		})
+		if data := mustGet(t, m, "lock/k"); data.Value != order[0] {
+			t.Fatalf("batch %v stored %q, want the earlier write", order, data.Value)
+		}
+	}
+}
+
+func TestReplicatedBatchIgnoresOrder(t *testing.T) {
+	a := Patch{Key: "k", Value: "a", Timestamp: 5}
+	b := Patch{Key: "k", Value: "b", Timestamp: 5}
+	for _, order := range [][]Patch{{a, b}, {b, a}} {
+		m := NewLWWMap("n0", nil)
+		m.Apply(order)
+		if data := mustGet(t, m, "k"); data.Value != "b" {
+			t.Fatalf("batch %v stored %q, want the value tie-break winner", order, data.Value)
+		}
+	}
+}
+
+func TestVersionFollowsWinningWrites(t *testing.T) {
+	nodes, transport := newCluster(2, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	n0.fwwPrefixes = []string{"lock/"}
+
+	for i, value := range []string{"a", "b", "c"} {
+		n0.ApplyClient(write("k", value))
+		if version := mustGet(t, n0, "k").Version; version != uint64(i+1) {
+			t.Fatalf("winning write %q got version %d, want %d", value, version, i+1)
+		}
+	}
+
+	// an older replicated write loses and leaves the version alone
+	n0.Apply([]Patch{{Key: "k", Value: "old", Timestamp: 1, Node: "n1", Version: 1}})
+	if version := mustGet(t, n0, "k").Version; version != 3 {
+		t.Fatalf("losing write moved the version to %d", version)
+	}
+
+	n0.ApplyClient(write("lock/k", "first"))
+	n0.ApplyClient(write("lock/k", "second"))
+	if version := mustGet(t, n0, "lock/k").Version; version != 1 {
+		t.Fatalf("rejected write moved the version to %d", version)
+	}
+
+	// a replica that fails over sees the same version for the same write
+	transport.SendOps(context.Background(), "n1", n0.snapshot())
+	if a, b := mustGet(t, n0, "k"), mustGet(t, n1, "k"); a != b {
+		t.Fatalf("n0 has %+v, n1 has %+v", a, b)
+	}
+}
+
+func TestVersionGoesUpOnEarlierFirstWrite(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.fwwPrefixes = []string{"lock/"}
+	m.Apply([]Patch{{Key: "lock/k", Value: "late", Timestamp: 10, Node: "n1", Version: 10}})
+	m.Apply([]Patch{{Key: "lock/k", Value: "early", Timestamp: 3, Node: "n2", Version: 3}})
+
+	if data := mustGet(t, m, "lock/k"); data.Value != "early" || data.Version != 11 {
+		t.Fatalf("stored %+v, want the earlier write at version 11", data)
+	}
+}
+
+func TestVersionGoesUpOnTieBreakAndConverges(t *testing.T) {
+	a := Patch{Key: "k", Value: "a", Timestamp: 5, Node: "n1", Version: 5}
+	b := Patch{Key: "k", Value: "b", Timestamp: 5, Node: "n2", Version: 5}
+
+	// n0 saw a first, so b's tie-break win counts past it; n1 only saw b
+	nodes, transport := newCluster(2, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	n0.Apply([]Patch{a})
+	n0.Apply([]Patch{b})
+	n1.Apply([]Patch{b})
+	if data := mustGet(t, n0, "k"); data.Value != "b" || data.Version != 6 {
+		t.Fatalf("n0 stored %+v, want b at version 6", data)
+	}
+
+	ctx := context.Background()
+	transport.SendOps(ctx, "n1", n0.snapshot())
+	transport.SendOps(ctx, "n0", n1.snapshot())
+	if x, y := mustGet(t, n0, "k"), mustGet(t, n1, "k"); x != y || x.Version != 6 {
+		t.Fatalf("n0 has %+v, n1 has %+v, want both at version 6", x, y)
+	}
+	if x, _ := n0.keyspaceHash(); x != func() string { y, _ := n1.keyspaceHash(); return y }() {
+		t.Fatal("keyspace hashes differ after the versions settled")
+	}
+}
+
+func typeOf(t *testing.T, m *LWWMap, key string) KeyType {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Type(w, httptest.NewRequest(http.MethodGet, "/type?key="+key, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d for %s", w.Code, key)
+	}
+	var keyType KeyType
+	if err := json.NewDecoder(w.Body).Decode(&keyType); err != nil {
+		t.Fatal(err)
+	}
+	return keyType
+}
+
+func TestTypeReportsTheRegisterBehindAKey(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.fwwPrefixes = []string{"lock/"}
+	m.ApplyClient(write("plain", "v"))
+	m.ApplyClient(write("lock/a", "v"))
+
+	for _, want := range []KeyType{
+		{Key: "plain", Type: "lww-register", Exists: true},
+		{Key: "lock/a", Type: "fww-register", Exists: true},
+		{Key: "lock/b", Type: "fww-register", Exists: false},
+		{Key: "other", Type: "lww-register", Exists: false},
+		{Key: "__stats/keycount", Type: "virtual", Exists: true},
+	} {
+		if got := typeOf(t, m, want.Key); got != want {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	m.Type(w, httptest.NewRequest(http.MethodGet, "/type", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d without a key, want 400", w.Code)
+	}
+}
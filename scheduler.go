@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// syncScheduler adapts the gossip interval: rounds that follow local changes
+// pull it toward min, idle rounds push it toward max. Each adjustment is
+// randomized so nodes don't fall into lockstep.
+type syncScheduler struct {
+	min time.Duration
+	max time.Duration
+	// an abandoned loop may still finish its round next to a fresh one
+	mu       sync.Mutex
+	interval time.Duration
+}
+
+func newSyncScheduler(min, max time.Duration) *syncScheduler {
+	return &syncScheduler{
+		min:      min,
+		max:      max,
+		interval: min,
+	}
+}
+
+// next returns the interval with +-50% jitter
+func (s *syncScheduler) next() time.Duration {
+	interval := s.current()
+	return interval/2 + time.Duration(rand.Int63n(int64(interval)+1))
+}
+
+// current returns the interval without jitter
+func (s *syncScheduler) current() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.interval
+}
+
+func (s *syncScheduler) observe(productive bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if productive {
+		s.interval = max(s.min, time.Duration(float64(s.interval)*(0.4+0.2*rand.Float64())))
+	} else {
+		s.interval = min(s.max, time.Duration(float64(s.interval)*(1.4+0.2*rand.Float64())))
+	}
+}
+
+// wait sleeps until the next round or until ctx is done. A change while
+// idling cuts the wait short, so a fresh write is gossiped within about one
+// min interval.
+func (s *syncScheduler) wait(ctx context.Context, changed <-chan struct{}) {
+	timer := time.NewTimer(s.next())
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return
+	case <-ctx.Done():
+		return
+	case <-changed:
+		s.mu.Lock()
+		s.interval = s.min
+		s.mu.Unlock()
+		timer.Reset(s.next())
+	}
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// longestWait bounds a single wait: the max interval with its jitter, plus
+// the min interval with its jitter when a change cuts it short
+func (s *syncScheduler) longestWait() time.Duration {
+	return (s.max + s.min) * 3 / 2
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// counting counts the batches sent over the MemoryTransport it wraps
+type counting struct {
+	*MemoryTransport
+	sends atomic.Int64
+}
+
+func (c *counting) SendOps(ctx context.Context, replica string, operations []Patch) error {
+	c.sends.Add(1)
+	return c.MemoryTransport.SendOps(ctx, replica, operations)
+}
+
+func TestIdleClusterBacksOffAndStillPropagatesFast(t *testing.T) {
+	const minInterval, maxInterval = 5 * time.Millisecond, 100 * time.Millisecond
+	nodes, memory := newCluster(2, NewMemoryStore)
+	transport := &counting{MemoryTransport: memory}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, node := range nodes {
+		node.transport = transport
+		node.scheduler = newSyncScheduler(minInterval, maxInterval)
+		go node.sync(ctx)
+	}
+	n0, n1 := nodes[0], nodes[1]
+	n0.ApplyClient(write("k", "v"))
+
+	// idle rounds stretch the interval towards max
+	time.Sleep(time.Second)
+	if interval := statsOf(t, n0).SyncIntervalMillis; interval != float64(maxInterval/time.Millisecond) {
+		t.Fatalf("idle interval is %vms, want the max of %v", interval, maxInterval)
+	}
+	before := transport.sends.Load()
+	time.Sleep(time.Second)
+	// about one batch per node and max interval, against 400 in a second if
+	// they kept gossiping at the min interval
+	if idle := transport.sends.Load() - before; idle > 2*int64(time.Second/maxInterval)*3/2 {
+		t.Fatalf("idle cluster sent %d batches in a second", idle)
+	}
+
+	// a fresh write cuts the wait back to about the min interval
+	start := time.Now()
+	n0.ApplyClient(write("fresh", "v"))
+	for {
+		if _, exists := n1.lookup("fresh"); exists {
+			break
+		}
+		if time.Since(start) > 10*minInterval {
+			t.Fatalf("fresh write took over %v to propagate, the max interval is %v", 10*minInterval, maxInterval)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
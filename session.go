@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// sessionHeader carries a client session's token, "<node>:<clock>": the
+// node that took all of the session's writes ("*" once they span several)
+// and a clock at or above every one of them. Clients echo the token from
+// their last write on later writes and reads. This is best effort: it
+// gives monotonic writes, and read-your-writes as far as a repair read
+// reaches the node holding the write.
+const sessionHeader = "X-Session-Token"
+
+const anyNode = "*"
+
+var errInvalidSession = errors.New("session token must be <node>:<clock>")
+
+type session struct {
+	node  string
+	clock Clock
+}
+
+func parseSession(r *http.Request) (session, bool, error) {
+	token := r.Header.Get(sessionHeader)
+	if token == "" {
+		return session{}, false, nil
+	}
+	node, clock, found := strings.Cut(token, ":")
+	value, err := strconv.Atoi(clock)
+	if !found || node == "" || err != nil || value < 0 {
+		return session{}, false, errInvalidSession
+	}
+	return session{node: node, clock: Clock(value)}, true, nil
+}
+
+// sessionWrite moves the clock past the session's earlier writes, so the
+// write about to be applied is stamped after them even on another node
+func (m *LWWMap) sessionWrite(r *http.Request) (session, bool, error) {
+	s, ok, err := parseSession(r)
+	if !ok {
+		return s, ok, err
+	}
+	m.mu.Lock()
+	m.clock = max(m.clock, s.clock+1)
+	m.mu.Unlock()
+	return s, true, nil
+}
+
+// sessionToken returns the token to hand back after a session's write
+func (m *LWWMap) sessionToken(previous session, continued bool) string {
+	m.mu.Lock()
+	clock := m.clock - 1
+	m.mu.Unlock()
+
+	node := m.nodeID
+	if continued && previous.node != m.nodeID {
+		node = anyNode
+	}
+	return node + ":" + strconv.Itoa(int(clock))
+}
+
+// sessionConsistency returns the consistency a read must use. A session
+// whose writes didn't all land on this node gets at least a repair read,
+// since they may not have been gossiped here yet.
+func (m *LWWMap) sessionConsistency(r *http.Request) (string, error) {
+	consistency := r.URL.Query().Get("consistency")
+	s, ok, err := parseSession(r)
+	if !ok || s.node == m.nodeID {
+		return consistency, err
+	}
+	if consistency == "" || consistency == "local" {
+		return "repair", nil
+	}
+	return consistency, nil
+}
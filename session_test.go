@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sessionPatch writes key on m as a client of the session holding token
+// and returns the session's next token
+func sessionPatch(t *testing.T, m *LWWMap, token, key, value string) string {
+	t.Helper()
+	body := `[{"key":"` + key + `","value":"` + value + `","timestamp":-1}]`
+	r := httptest.NewRequest(http.MethodPost, "/patch", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set(sessionHeader, token)
+	}
+	w := httptest.NewRecorder()
+	m.Patch(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("write of %s got status %d", key, w.Code)
+	}
+	return w.Header().Get(sessionHeader)
+}
+
+func sessionGet(t *testing.T, m *LWWMap, token, key string) Data {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/getKey", strings.NewReader(`{"key":"`+key+`"}`))
+	r.Header.Set(sessionHeader, token)
+	w := httptest.NewRecorder()
+	m.Get(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("read of %s on node %s got status %d", key, m.nodeID, w.Code)
+	}
+	var data Data
+	if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSessionReadsItsWritesAcrossNodes(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+
+	// A goes to one node and B fails over to the other before any gossip
+	token := sessionPatch(t, nodes[0], "", "a", "A")
+	if !strings.HasPrefix(token, "n0:") {
+		t.Fatalf("got token %q, want one pinned to n0", token)
+	}
+	token = sessionPatch(t, nodes[1], token, "b", "B")
+	if !strings.HasPrefix(token, anyNode+":") {
+		t.Fatalf("got token %q, want one spanning nodes", token)
+	}
+
+	for _, node := range nodes {
+		a, b := sessionGet(t, node, token, "a"), sessionGet(t, node, token, "b")
+		if a.Value != "A" || b.Value != "B" {
+			t.Fatalf("node %s served %q and %q", node.nodeID, a.Value, b.Value)
+		}
+		if b.Timestamp <= a.Timestamp {
+			t.Fatalf("B stamped %d, not after A at %d", b.Timestamp, a.Timestamp)
+		}
+	}
+}
+
+func TestInvalidSessionToken(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	r := httptest.NewRequest(http.MethodPost, "/patch", strings.NewReader(`[{"key":"k","value":"v","timestamp":-1}]`))
+	r.Header.Set(sessionHeader, "garbage")
+	w := httptest.NewRecorder()
+	m.Patch(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchCheck fails the test when a value at or over the limit is sent in a
+// batch with other entries
+type batchCheck struct {
+	Transport
+	t     *testing.T
+	limit int
+}
+
+func (b *batchCheck) SendOps(ctx context.Context, replica string, operations []Patch) error {
+	for _, op := range operations {
+		if len(op.Value) >= b.limit && len(operations) > 1 {
+			b.t.Errorf("large value %s sent in a batch of %d", op.Key, len(operations))
+		}
+	}
+	return b.Transport.SendOps(ctx, replica, operations)
+}
+
+// lockWaits times how long taking mu blocks, polling until stop is closed
+func lockWaits(mu *sync.Mutex, stop <-chan struct{}) <-chan time.Duration {
+	longest := make(chan time.Duration, 1)
+	go func() {
+		var worst time.Duration
+		for {
+			select {
+			case <-stop:
+				longest <- worst
+				return
+			default:
+			}
+			start := time.Now()
+			mu.Lock()
+			worst = max(worst, time.Since(start))
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return longest
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// TestLargeValueSoak keeps overwriting values at the large-value limit and
+// replicating them over HTTP. The heap must not grow with the rounds and no
+// apply may hold either node's lock for long.
+func TestLargeValueSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test")
+	}
+	const (
+		limit       = 1 << 20
+		largeKeys   = 8
+		smallKeys   = 200
+		rounds      = 12
+		maxHeapGrow = 4 * limit
+		maxLockWait = 50 * time.Millisecond
+	)
+
+	n1 := NewLWWMap("n1", nil)
+	server := httptest.NewServer(n1.routes(""))
+	defer server.Close()
+	replica := server.Listener.Addr().String()
+
+	n0 := NewLWWMap("n0", []string{replica})
+	n0.transport = &batchCheck{Transport: n0.transport, t: t, limit: limit}
+	for _, m := range []*LWWMap{n0, n1} {
+		m.largeValueBytes = limit
+	}
+	for i := range smallKeys {
+		n0.ApplyClient(write(fmt.Sprintf("small%d", i), "v"))
+	}
+
+	stop := make(chan struct{})
+	waits := []<-chan time.Duration{lockWaits(&n0.mu, stop), lockWaits(&n1.mu, stop)}
+
+	ctx := context.Background()
+	var baseline uint64
+	for round := range rounds {
+		for i := range largeKeys {
+			value := strings.Repeat(string(rune('a'+round%26)), limit)
+			n0.ApplyClient(write(fmt.Sprintf("large%d", i), value))
+		}
+		if err := n0.push(ctx, replica, n0.snapshot()); err != nil {
+			t.Fatal(err)
+		}
+		n0.syncRound(ctx, 0)
+		// the first rounds size the pools and buffers that are reused later
+		if round == 2 {
+			baseline = heapInUse()
+		}
+	}
+	grown := int64(heapInUse()) - int64(baseline)
+	close(stop)
+	t.Logf("heap grew by %d bytes after warm-up", grown)
+
+	if grown > maxHeapGrow {
+		t.Errorf("heap grew by %d bytes over %d rounds, want at most %d", grown, rounds-3, maxHeapGrow)
+	}
+	for i, wait := range waits {
+		longest := <-wait
+		t.Logf("longest wait for the n%d lock was %v", i, longest)
+		if longest > maxLockWait {
+			t.Errorf("n%d lock was waited on for %v, want at most %v", i, longest, maxLockWait)
+		}
+	}
+	local, _ := n0.keyspaceHash()
+	if remote, _ := n1.keyspaceHash(); local != remote {
+		t.Fatal("nodes did not converge")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// lockStats tracks how long applies hold the store lock, guarded by m.mu
+type lockStats struct {
+	applies int
+	total   time.Duration
+	longest time.Duration
+}
+
+func (s *lockStats) record(held time.Duration) {
+	s.applies++
+	s.total += held
+	s.longest = max(s.longest, held)
+}
+
+type LockStats struct {
+	Applies     int     `json:"applies"`
+	TotalMillis float64 `json:"totalMillis"`
+	MaxMillis   float64 `json:"maxMillis"`
+}
+
+type Stats struct {
+	Keys      int       `json:"keys"`
+	Clock     Clock     `json:"clock"`
+	ApplyLock LockStats `json:"applyLock"`
+	// patch bodies admitted and rejected per class of sender
+	Admission map[string]AdmissionStats `json:"admission"`
+	Queues    Queues                    `json:"queues"`
+	Conflicts ConflictStats             `json:"conflicts"`
+	// times the gossip loop was restarted after a panic or stall
+	SyncRestarts int64 `json:"syncRestarts"`
+	// the gossip interval the scheduler has adapted to, before jitter
+	SyncIntervalMillis float64 `json:"syncIntervalMillis"`
+	// gossiped operations dropped per origin node over its quota
+	GossipDropped map[string]int `json:"gossipDropped,omitempty"`
+}
+
+type QueueDepth struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+func (q QueueDepth) fill() float64 {
+	if q.Capacity == 0 {
+		return 0
+	}
+	return float64(q.Depth) / float64(q.Capacity)
+}
+
+// Queues reports the buffers between the apply path and its consumers.
+// Backpressure is the fullest of them, and of the admission pools, as a
+// fraction between 0 and 1.
+type Queues struct {
+	Recorder *QueueDepth `json:"recorder,omitempty"`
+	Views    QueueDepth  `json:"views"`
+	// client batches held until maintenance ends
+	Maintenance  QueueDepth `json:"maintenance"`
+	Backpressure float64    `json:"backpressure"`
+}
+
+func (m *LWWMap) Stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.mu.Lock()
+	stats := Stats{
+		Keys:  m.store.Len(),
+		Clock: m.clock,
+		ApplyLock: LockStats{
+			Applies:     m.lockStats.applies,
+			TotalMillis: float64(m.lockStats.total) / float64(time.Millisecond),
+			MaxMillis:   float64(m.lockStats.longest) / float64(time.Millisecond),
+		},
+		Conflicts: ConflictStats{
+			Total:      m.conflicts.total,
+			Sampled:    m.conflicts.sampled,
+			SampleRate: m.conflicts.sampleRate,
+		},
+	}
+	for view := range m.views {
+		stats.Queues.Views.Depth += len(view.changes)
+		stats.Queues.Views.Capacity += cap(view.changes)
+		stats.Queues.Backpressure = max(stats.Queues.Backpressure, QueueDepth{len(view.changes), cap(view.changes)}.fill())
+	}
+	m.mu.Unlock()
+	stats.SyncRestarts = m.syncSupervisor.restarts.Load()
+	stats.SyncIntervalMillis = float64(m.scheduler.current()) / float64(time.Millisecond)
+	m.maintenance.mu.Lock()
+	stats.Queues.Maintenance = QueueDepth{Depth: len(m.maintenance.queue), Capacity: maxQueuedWrites}
+	m.maintenance.mu.Unlock()
+	stats.Queues.Backpressure = max(stats.Queues.Backpressure, stats.Queues.Maintenance.fill())
+	if m.recorder != nil {
+		stats.Queues.Recorder = &QueueDepth{Depth: len(m.recorder.records), Capacity: cap(m.recorder.records)}
+		stats.Queues.Backpressure = max(stats.Queues.Backpressure, stats.Queues.Recorder.fill())
+	}
+	stats.Admission = map[string]AdmissionStats{
+		"peer":   m.peerAdmission.stats(),
+		"client": m.clientAdmission.stats(),
+	}
+	if m.originQuota != nil {
+		stats.GossipDropped = m.originQuota.drops()
+	}
+	for _, pool := range stats.Admission {
+		stats.Queues.Backpressure = max(stats.Queues.Backpressure, min(float64(pool.InFlightBytes)/float64(pool.CapacityBytes), 1))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
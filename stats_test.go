@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func statsOf(t *testing.T, m *LWWMap) Stats {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Stats(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats Stats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestStatsReportMaintenanceQueue(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.setMaintenance(true)
+	for i := range 3 {
+		w := httptest.NewRecorder()
+		m.Patch(w, httptest.NewRequest(http.MethodPost, "/patch", strings.NewReader(`[{"key":"k","value":"`+itoa(Clock(i))+`","timestamp":-1}]`)))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("write during maintenance got status %d, want 202", w.Code)
+		}
+	}
+
+	queue := statsOf(t, m).Queues.Maintenance
+	if queue.Depth != 3 || queue.Capacity != maxQueuedWrites {
+		t.Fatalf("got queue %+v, want 3 of %d", queue, maxQueuedWrites)
+	}
+
+	m.setMaintenance(false)
+	if queue := statsOf(t, m).Queues.Maintenance; queue.Depth != 0 {
+		t.Fatalf("got depth %d after maintenance, want the queue drained", queue.Depth)
+	}
+	if data := mustGet(t, m, "k"); data.Value != "2" {
+		t.Fatalf("got %q, want the last queued write", data.Value)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"iter"
+	"maps"
+)
+
+// Store holds the entries of the map. LWWMap calls it with m.mu held, so
+// implementations need no locking of their own. The in-memory map is the
+// default; the file store (STORE_FILE) lets values outgrow RAM.
+type Store interface {
+	Get(key string) (Data, bool)
+	Set(key string, data Data)
+	Len() int
+	// All iterates every entry in no particular order
+	All() iter.Seq2[string, Data]
+}
+
+type memoryStore map[string]Data
+
+func NewMemoryStore() Store {
+	return make(memoryStore)
+}
+
+func (s memoryStore) Get(key string) (Data, bool) {
+	data, exists := s[key]
+	return data, exists
+}
+
+func (s memoryStore) Set(key string, data Data) {
+	s[key] = data
+}
+
+func (s memoryStore) Len() int {
+	return len(s)
+}
+
+func (s memoryStore) All() iter.Seq2[string, Data] {
+	return maps.All(s)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// syncSupervisor keeps the gossip loop alive. A loop that panics is
+// restarted after a backoff that doubles with each panic in a row. One that
+// makes no progress for stall is cancelled and abandoned, since the call it
+// hangs in may ignore cancellation, and a new one starts right away. The
+// abandoned loop ends on its own once that call returns.
+type syncSupervisor struct {
+	stall time.Duration
+	// first delay before restarting a panicked loop, and its cap
+	backoff    time.Duration
+	maxBackoff time.Duration
+	progress   atomic.Int64
+	restarts   atomic.Int64
+}
+
+// syncExit is how a sync loop ended
+type syncExit struct {
+	panicked bool
+	// rounds completed before it ended
+	rounds int
+}
+
+// sync supervises gossip loops until ctx is done
+func (m *LWWMap) sync(ctx context.Context) {
+	s := &m.syncSupervisor
+	backoff := s.backoff
+	for {
+		loopCtx, cancel := context.WithCancel(ctx)
+		s.progress.Store(time.Now().UnixNano())
+		done := make(chan syncExit, 1)
+		go func() { done <- m.syncLoop(loopCtx) }()
+
+		exit, stalled := s.watch(done)
+		cancel()
+		if stalled {
+			log.Printf("Node %s sync loop made no progress for %v, abandoning it", m.nodeID, s.stall)
+			go func() {
+				<-done
+				log.Printf("Node %s abandoned sync loop returned", m.nodeID)
+			}()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if exit.rounds > 0 {
+			// the loop was healthy for a while, so this is a fresh failure
+			backoff = s.backoff
+		}
+		log.Printf("Node %s restarting its sync loop (%d restarts)", m.nodeID, s.restarts.Add(1))
+		if !exit.panicked {
+			continue
+		}
+		log.Printf("Node %s waiting %v before restarting a panicked sync loop", m.nodeID, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, s.maxBackoff)
+	}
+}
+
+// watch waits for the loop to end, or reports it stalled
+func (s *syncSupervisor) watch(done <-chan syncExit) (syncExit, bool) {
+	ticker := time.NewTicker(s.stall / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case exit := <-done:
+			return exit, false
+		case <-ticker.C:
+			if time.Since(time.Unix(0, s.progress.Load())) > s.stall {
+				return syncExit{}, true
+			}
+		}
+	}
+}
+
+// roundTimeout bounds a round's network calls. The wait before the round
+// comes on top of it, and a quarter of what the longest wait leaves of stall
+// is kept as margin, so a hung round gives up before it counts as a stall.
+func (s *syncSupervisor) roundTimeout(longestWait time.Duration) time.Duration {
+	return (s.stall - longestWait) * 3 / 4
+}
+
+// syncLoop runs gossip rounds until ctx is done or a round panics
+func (m *LWWMap) syncLoop(ctx context.Context) (exit syncExit) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("Node %s sync loop panicked: %v\n%s", m.nodeID, recovered, debug.Stack())
+			exit.panicked = true
+		}
+	}()
+
+	s := &m.syncSupervisor
+	timeout := s.roundTimeout(m.scheduler.longestWait())
+	lastChanges := 0
+	for {
+		m.scheduler.wait(ctx, m.changed)
+		if ctx.Err() != nil {
+			return exit
+		}
+		roundCtx, cancel := context.WithTimeout(ctx, timeout)
+		lastChanges = m.syncRound(roundCtx, lastChanges)
+		cancel()
+		exit.rounds++
+		if ctx.Err() == nil {
+			// an abandoned loop must not vouch for its replacement
+			s.progress.Store(time.Now().UnixNano())
+		}
+	}
+}
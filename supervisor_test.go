@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// panicking panics on its first panics sends, then delivers like the
+// MemoryTransport it wraps
+type panicking struct {
+	*MemoryTransport
+	panics atomic.Int64
+}
+
+func (p *panicking) SendOps(ctx context.Context, replica string, operations []Patch) error {
+	if p.panics.Add(-1) >= 0 {
+		panic("injected")
+	}
+	return p.MemoryTransport.SendOps(ctx, replica, operations)
+}
+
+// newSupervised builds two nodes where n0 gossips over transport with fast
+// intervals and backoff
+func newSupervised(panics int64, backoff time.Duration) (*LWWMap, *LWWMap, *panicking) {
+	nodes, memory := newCluster(2, NewMemoryStore)
+	transport := &panicking{MemoryTransport: memory}
+	transport.panics.Store(panics)
+	n0 := nodes[0]
+	n0.transport = transport
+	n0.scheduler = newSyncScheduler(time.Millisecond, 5*time.Millisecond)
+	n0.syncSupervisor.stall = time.Second
+	n0.syncSupervisor.backoff = backoff
+	n0.syncSupervisor.maxBackoff = time.Second
+	return n0, nodes[1], transport
+}
+
+func TestSyncLoopRestartsAfterPanic(t *testing.T) {
+	n0, n1, _ := newSupervised(2, time.Millisecond)
+	n0.ApplyClient(write("k", "v"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		n0.sync(ctx)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, exists := n1.lookup("k"); exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("gossip did not resume after the loop panicked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if restarts := n0.syncSupervisor.restarts.Load(); restarts != 2 {
+		t.Fatalf("got %d restarts, want 2", restarts)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("sync did not return after its context was cancelled")
+	}
+}
+
+func TestPanickingSyncLoopBacksOff(t *testing.T) {
+	n0, _, _ := newSupervised(1<<30, 20*time.Millisecond)
+	n0.ApplyClient(write("k", "v"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	n0.sync(ctx)
+
+	// 20+40+80+160ms of backoff fits at most five restarts into 300ms
+	if restarts := n0.syncSupervisor.restarts.Load(); restarts < 1 || restarts > 5 {
+		t.Fatalf("got %d restarts in 300ms, want the backoff to keep it to 1..5", restarts)
+	}
+}
+
+// hanging blocks its first hangs sends until release is closed, ignoring
+// their context, then delivers like the MemoryTransport it wraps
+type hanging struct {
+	*MemoryTransport
+	hangs   atomic.Int64
+	release chan struct{}
+}
+
+func (h *hanging) SendOps(ctx context.Context, replica string, operations []Patch) error {
+	if h.hangs.Add(-1) >= 0 {
+		<-h.release
+	}
+	return h.MemoryTransport.SendOps(ctx, replica, operations)
+}
+
+func TestStalledSyncLoopIsReplaced(t *testing.T) {
+	n0, n1, _ := newSupervised(0, time.Millisecond)
+	transport := &hanging{MemoryTransport: n0.transport.(*panicking).MemoryTransport, release: make(chan struct{})}
+	transport.hangs.Store(1)
+	defer close(transport.release)
+	n0.transport = transport
+	n0.syncSupervisor.stall = 100 * time.Millisecond
+	n0.ApplyClient(write("k", "v"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n0.sync(ctx)
+
+	// the first loop is still hung when the key arrives, so a fresh loop
+	// must have taken over without waiting for it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, exists := n1.lookup("k"); exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("gossip did not resume while the stalled loop was hung")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if restarts := n0.syncSupervisor.restarts.Load(); restarts < 1 {
+		t.Fatalf("got %d restarts, want the stalled loop replaced", restarts)
+	}
+}
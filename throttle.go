@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits throughput to rate units per second with bursts of up
+// to burst units
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// now is time.Now outside of tests
+	now func() time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// refill credits the tokens earned since the last call, b.mu must be held
+func (b *tokenBucket) refill() {
+	now := b.now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long the caller must wait before
+// using them. Requests larger than the burst go into debt instead of failing.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	timer := time.NewTimer(b.reserve(n))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// opsSize approximates the encoded size of a batch without marshaling it
+func opsSize(operations []Patch) int {
+	size := 2
+	for _, op := range operations {
+		size += len(op.Key) + len(op.Value) + 48
+	}
+	return size
+}
+
+// allow takes n tokens if they are available right now
+func (b *tokenBucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// splitBatch cuts operations into batches of at most maxOps. Values of
+// largeValue bytes or more always travel alone, so one huge entry is never
+// marshaled together with many small ones.
+func splitBatch(operations []Patch, maxOps int, largeValue int) [][]Patch {
+	batches := [][]Patch{}
+	batch := []Patch{}
+	for _, op := range operations {
+		if len(op.Value) >= largeValue {
+			batches = append(batches, []Patch{op})
+			continue
+		}
+		batch = append(batch, op)
+		if len(batch) == maxOps {
+			batches = append(batches, batch)
+			batch = []Patch{}
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
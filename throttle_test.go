@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBucket returns a bucket on a clock that only moves when advance is
+// called
+func fakeBucket(rate, burst float64) (*tokenBucket, func(time.Duration)) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(rate, burst)
+	b.last = now
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestBucketPacesBeyondTheBurst(t *testing.T) {
+	b, advance := fakeBucket(1000, 500)
+
+	if wait := b.reserve(500); wait != 0 {
+		t.Fatalf("the burst waited %v", wait)
+	}
+	if wait := b.reserve(250); wait != 250*time.Millisecond {
+		t.Fatalf("got %v for 250 over the burst, want 250ms", wait)
+	}
+	// debt adds up until time pays it off
+	if wait := b.reserve(1000); wait != 1250*time.Millisecond {
+		t.Fatalf("got %v with debt outstanding, want 1.25s", wait)
+	}
+	advance(1250 * time.Millisecond)
+	if wait := b.reserve(100); wait != 100*time.Millisecond {
+		t.Fatalf("got %v once the debt was paid, want 100ms", wait)
+	}
+}
+
+func TestBucketRefillStopsAtTheBurst(t *testing.T) {
+	b, advance := fakeBucket(1000, 500)
+	b.reserve(500)
+	advance(time.Hour)
+
+	if !b.allow(500) {
+		t.Fatal("a full burst was refused after an idle hour")
+	}
+	if b.allow(1) {
+		t.Fatal("an idle hour credited more than the burst")
+	}
+}
+
+func TestLargeValuesTravelAlone(t *testing.T) {
+	large := strings.Repeat("x", 100)
+	operations := []Patch{{Key: "a"}, {Key: "b", Value: large}, {Key: "c"}, {Key: "d"}, {Key: "e"}}
+
+	batches := splitBatch(operations, 2, 100)
+	got := [][]string{}
+	for _, batch := range batches {
+		keys := []string{}
+		for _, op := range batch {
+			keys = append(keys, op.Key)
+		}
+		got = append(got, keys)
+	}
+	if fmt.Sprint(got) != "[[b] [a c] [d e]]" {
+		t.Fatalf("got batches %v, want [[b] [a c] [d e]]", got)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transport carries operations between replicas. The HTTP transport is the
+// default; embedding applications can supply their own.
+type Transport interface {
+	SendOps(ctx context.Context, replica string, operations []Patch) error
+	KeyspaceHash(ctx context.Context, replica string) (Hash, error)
+	BucketHashes(ctx context.Context, replica string) ([]string, error)
+	FetchKey(ctx context.Context, replica string, key string) (Data, bool, error)
+	// Wants returns the keys among digests whose values replica needs
+	Wants(ctx context.Context, replica string, digests []Digest) ([]string, error)
+	// StartCut has replica keep overwritten entries for a consistent cut,
+	// if it doesn't already, and returns its clock
+	StartCut(ctx context.Context, replica string) (Clock, error)
+	// ExportCut returns replica's entries as they were at barrier
+	ExportCut(ctx context.Context, replica string, barrier Clock) ([]Patch, error)
+	EndCut(ctx context.Context, replica string) error
+}
+
+// RejectedError means the replica refused the batch for good and resending
+// it won't help
+type RejectedError struct {
+	Replica string
+	Status  int
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("replica %s rejected batch with status %d", e.Replica, e.Status)
+}
+
+// ThrottledError means the replica is overloaded and asked the sender to
+// slow down; the batch is fine and can be resent after RetryAfter
+type ThrottledError struct {
+	Replica    string
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("replica %s is throttling, retry after %v", e.Replica, e.RetryAfter)
+}
+
+type HTTPTransport struct {
+	nodeID string
+	client *http.Client
+
+	// a misbehaving peer can't make us buffer more than this per response
+	maxResponseBytes int64
+	// every node in the cluster serves its endpoints under the same prefix
+	routePrefix string
+	// proves to peers that requests come from a node, empty sends none
+	secret string
+}
+
+func NewHTTPTransport(nodeID string) *HTTPTransport {
+	return &HTTPTransport{
+		nodeID: nodeID,
+		client: http.DefaultClient,
+
+		maxResponseBytes: 64 << 20,
+	}
+}
+
+func (t *HTTPTransport) url(replica string, path string) string {
+	return "http://" + replica + t.routePrefix + path
+}
+
+// identify marks req as coming from this node
+func (t *HTTPTransport) identify(req *http.Request) {
+	req.Header.Set(nodeHeader, t.nodeID)
+	if t.secret != "" {
+		req.Header.Set(secretHeader, t.secret)
+	}
+}
+
+// decode reads a peer response into v, aborting once it passes maxResponseBytes
+func (t *HTTPTransport) decode(replica string, body io.Reader, v any) error {
+	limited := &io.LimitedReader{R: body, N: t.maxResponseBytes + 1}
+	err := json.NewDecoder(limited).Decode(v)
+	if limited.N <= 0 {
+		return fmt.Errorf("response from %s exceeds %d bytes", replica, t.maxResponseBytes)
+	}
+	return err
+}
+
+func (t *HTTPTransport) SendOps(ctx context.Context, replica string, operations []Patch) error {
+	url := t.url(replica, "/patch")
+	data, err := json.Marshal(operations)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	t.identify(req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter := time.Second
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return &ThrottledError{Replica: replica, RetryAfter: retryAfter}
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return &RejectedError{Replica: replica, Status: resp.StatusCode}
+	default:
+		return fmt.Errorf("replica %s returned status %d", replica, resp.StatusCode)
+	}
+}
+
+func (t *HTTPTransport) KeyspaceHash(ctx context.Context, replica string) (Hash, error) {
+	var hash Hash
+	err := t.get(ctx, replica, "/hash", &hash)
+	return hash, err
+}
+
+func (t *HTTPTransport) BucketHashes(ctx context.Context, replica string) ([]string, error) {
+	var hashes []string
+	err := t.get(ctx, replica, "/buckets", &hashes)
+	return hashes, err
+}
+
+func (t *HTTPTransport) get(ctx context.Context, replica string, path string, v any) error {
+	return t.call(ctx, http.MethodGet, replica, path, v)
+}
+
+// call sends a bodyless request and decodes the response into v unless it
+// is nil
+func (t *HTTPTransport) call(ctx context.Context, method string, replica string, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, t.url(replica, path), nil)
+	if err != nil {
+		return err
+	}
+	t.identify(req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("replica %s returned status %d", replica, resp.StatusCode)
+	}
+	if v == nil {
+		return nil
+	}
+	return t.decode(replica, resp.Body, v)
+}
+
+func (t *HTTPTransport) StartCut(ctx context.Context, replica string) (Clock, error) {
+	var state CutState
+	err := t.call(ctx, http.MethodPost, replica, "/cut", &state)
+	return state.Clock, err
+}
+
+func (t *HTTPTransport) ExportCut(ctx context.Context, replica string, barrier Clock) ([]Patch, error) {
+	var operations []Patch
+	err := t.get(ctx, replica, "/cut?barrier="+strconv.Itoa(int(barrier)), &operations)
+	return operations, err
+}
+
+func (t *HTTPTransport) EndCut(ctx context.Context, replica string) error {
+	return t.call(ctx, http.MethodDelete, replica, "/cut", nil)
+}
+
+// FetchKey reads the stored entry for key from replica, bypassing its read
+// interceptors and virtual keys
+func (t *HTTPTransport) FetchKey(ctx context.Context, replica string, key string) (Data, bool, error) {
+	var data Data
+	body, err := json.Marshal(Get{Key: key})
+	if err != nil {
+		return data, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url(replica, "/getKey"), bytes.NewReader(body))
+	if err != nil {
+		return data, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	t.identify(req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return data, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = t.decode(replica, resp.Body, &data)
+		return data, err == nil, err
+	case http.StatusNotFound:
+		return data, false, nil
+	default:
+		return data, false, fmt.Errorf("replica %s returned status %d", replica, resp.StatusCode)
+	}
+}
+
+func (t *HTTPTransport) Wants(ctx context.Context, replica string, digests []Digest) ([]string, error) {
+	var keys []string
+	body, err := json.Marshal(digests)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url(replica, "/digest"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	t.identify(req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("replica %s returned status %d", replica, resp.StatusCode)
+	}
+	err = t.decode(replica, resp.Body, &keys)
+	return keys, err
+}
+
+// MemoryTransport delivers operations directly to in-process nodes
+type MemoryTransport struct {
+	mu    sync.Mutex
+	nodes map[string]*LWWMap
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		nodes: make(map[string]*LWWMap),
+	}
+}
+
+func (t *MemoryTransport) Register(replica string, node *LWWMap) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes[replica] = node
+}
+
+func (t *MemoryTransport) node(replica string) (*LWWMap, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node, exists := t.nodes[replica]
+	if !exists {
+		return nil, fmt.Errorf("unknown replica %s", replica)
+	}
+	return node, nil
+}
+
+func (t *MemoryTransport) SendOps(ctx context.Context, replica string, operations []Patch) error {
+	node, err := t.node(replica)
+	if err != nil {
+		return err
+	}
+	node.Apply(operations)
+	return nil
+}
+
+func (t *MemoryTransport) KeyspaceHash(ctx context.Context, replica string) (Hash, error) {
+	node, err := t.node(replica)
+	if err != nil {
+		return Hash{}, err
+	}
+	hash, keys := node.keyspaceHash()
+	return Hash{Hash: hash, Keys: keys, Node: node.nodeID}, nil
+}
+
+func (t *MemoryTransport) BucketHashes(ctx context.Context, replica string) ([]string, error) {
+	node, err := t.node(replica)
+	if err != nil {
+		return nil, err
+	}
+	return node.bucketHashes(), nil
+}
+
+func (t *MemoryTransport) FetchKey(ctx context.Context, replica string, key string) (Data, bool, error) {
+	node, err := t.node(replica)
+	if err != nil {
+		return Data{}, false, err
+	}
+	data, exists := node.lookup(key)
+	return data, exists, nil
+}
+
+func (t *MemoryTransport) StartCut(ctx context.Context, replica string) (Clock, error) {
+	node, err := t.node(replica)
+	if err != nil {
+		return 0, err
+	}
+	return node.startCut(), nil
+}
+
+func (t *MemoryTransport) ExportCut(ctx context.Context, replica string, barrier Clock) ([]Patch, error) {
+	node, err := t.node(replica)
+	if err != nil {
+		return nil, err
+	}
+	return node.exportCut(barrier), nil
+}
+
+func (t *MemoryTransport) EndCut(ctx context.Context, replica string) error {
+	node, err := t.node(replica)
+	if err != nil {
+		return err
+	}
+	node.endCut()
+	return nil
+}
+
+func (t *MemoryTransport) Wants(ctx context.Context, replica string, digests []Digest) ([]string, error) {
+	node, err := t.node(replica)
+	if err != nil {
+		return nil, err
+	}
+	return node.wants(digests), nil
+}
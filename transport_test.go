@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHashRequestsIdentifyTheNode(t *testing.T) {
+	replica := NewLWWMap("n1", nil)
+	routes := replica.routes("")
+	identified := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identified[r.URL.Path] = r.Header.Get(nodeHeader) == "n0" && r.Header.Get(secretHeader) == "secret"
+		routes.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	transport := NewHTTPTransport("n0")
+	transport.secret = "secret"
+	address := strings.TrimPrefix(server.URL, "http://")
+	ctx := context.Background()
+	if _, err := transport.KeyspaceHash(ctx, address); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.BucketHashes(ctx, address); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/hash", "/buckets"} {
+		if !identified[path] {
+			t.Fatalf("request for %s did not carry the node ID and secret", path)
+		}
+	}
+}
+
+func TestOversizedResponsesAreRefused(t *testing.T) {
+	keys := make([]string, 10_000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/digest":
+			json.NewEncoder(w).Encode(keys)
+		case "/cut":
+			operations := make([]Patch, len(keys))
+			for i, key := range keys {
+				operations[i] = Patch{Key: key, Value: "v", Timestamp: Clock(i)}
+			}
+			json.NewEncoder(w).Encode(operations)
+		}
+	}))
+	defer server.Close()
+
+	transport := NewHTTPTransport("n0")
+	transport.maxResponseBytes = 4096
+	address := strings.TrimPrefix(server.URL, "http://")
+	ctx := context.Background()
+
+	if _, err := transport.Wants(ctx, address, nil); err == nil || !strings.Contains(err.Error(), "exceeds 4096 bytes") {
+		t.Fatalf("got %v for an oversized /digest response", err)
+	}
+	if _, err := transport.ExportCut(ctx, address, 0); err == nil || !strings.Contains(err.Error(), "exceeds 4096 bytes") {
+		t.Fatalf("got %v for an oversized /cut response", err)
+	}
+
+	transport.maxResponseBytes = 1 << 20
+	wanted, err := transport.Wants(ctx, address, nil)
+	if err != nil || len(wanted) != len(keys) {
+		t.Fatalf("got %d keys and %v under the limit", len(wanted), err)
+	}
+}
+
+func TestRoutesServeUnderThePrefix(t *testing.T) {
+	replica := NewLWWMap("n1", nil)
+	server := httptest.NewServer(replica.routes("/crdt"))
+	defer server.Close()
+
+	for path, want := range map[string]int{"/crdt/hash": http.StatusOK, "/hash": http.StatusNotFound, "/crdt/stats": http.StatusOK, "/stats": http.StatusNotFound} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("got status %d for %s, want %d", resp.StatusCode, path, want)
+		}
+	}
+
+	// peers are reached under the same prefix
+	transport := NewHTTPTransport("n0")
+	transport.routePrefix = "/crdt"
+	address := strings.TrimPrefix(server.URL, "http://")
+	if err := transport.SendOps(context.Background(), address, []Patch{{Key: "k", Value: "v", Timestamp: 1, Node: "n0"}}); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := transport.KeyspaceHash(context.Background(), address)
+	if err != nil || hash.Keys != 1 {
+		t.Fatalf("got %+v, %v from the prefixed /hash", hash, err)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// maxDatagram keeps a batch within one Ethernet frame, so it is never
+// fragmented at the IP layer
+const maxDatagram = 1400
+
+const (
+	datagramOps byte = 1
+	datagramAck byte = 2
+)
+
+// datagramVersion follows the type byte of an ops datagram and is bumped
+// whenever the operation encoding changes, so mixed-version clusters
+// refuse each other's datagrams instead of misparsing them
+const datagramVersion byte = 3
+
+var (
+	errMalformedDatagram = errors.New("malformed datagram")
+	errDatagramVersion   = errors.New("unsupported datagram version")
+)
+
+// UDPTransport sends operations to replicas as datagrams, each acked by the
+// receiver and retransmitted until it is. Batches are split to fit a
+// datagram; an operation too large for one goes over HTTP instead, as do
+// hash, bucket, key and digest requests.
+type UDPTransport struct {
+	*HTTPTransport
+	conn    *net.UDPConn
+	port    int
+	timeout time.Duration
+	retries int
+
+	seq     atomic.Uint64
+	mu      sync.Mutex
+	pending map[uint64]chan struct{}
+}
+
+// NewUDPTransport sends to replicas on port, the UDP port every node
+// listens on, from an ephemeral local port that receives the acks
+func NewUDPTransport(fallback *HTTPTransport, port int) (*UDPTransport, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	t := &UDPTransport{
+		HTTPTransport: fallback,
+		conn:          conn,
+		port:          port,
+		timeout:       200 * time.Millisecond,
+		retries:       5,
+		pending:       make(map[uint64]chan struct{}),
+	}
+	go t.readAcks()
+	return t, nil
+}
+
+func (t *UDPTransport) SendOps(ctx context.Context, replica string, operations []Patch) error {
+	host, _, err := net.SplitHostPort(replica)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(t.port)))
+	if err != nil {
+		return err
+	}
+
+	batches, oversized := packDatagrams(t.nodeID, operations)
+	for _, batch := range batches {
+		if err := t.sendDatagram(ctx, addr, batch); err != nil {
+			return fmt.Errorf("replica %s: %w", replica, err)
+		}
+	}
+	if len(oversized) > 0 {
+		return t.HTTPTransport.SendOps(ctx, replica, oversized)
+	}
+	return nil
+}
+
+func (t *UDPTransport) sendDatagram(ctx context.Context, addr *net.UDPAddr, operations []Patch) error {
+	seq := t.seq.Add(1)
+	datagram := sign(encodeOps(seq, t.nodeID, operations), t.secret)
+
+	acked := make(chan struct{})
+	t.mu.Lock()
+	t.pending[seq] = acked
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, seq)
+		t.mu.Unlock()
+	}()
+
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		if _, err := t.conn.WriteToUDP(datagram, addr); err != nil {
+			return err
+		}
+		timer := time.NewTimer(t.timeout)
+		select {
+		case <-acked:
+			timer.Stop()
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return fmt.Errorf("datagram %d not acked after %d retransmits", seq, t.retries)
+}
+
+func (t *UDPTransport) readAcks() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, _, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("UDP transport stopped reading acks: %v", err)
+			return
+		}
+		if n < 2 || buf[0] != datagramAck {
+			continue
+		}
+		seq, size := binary.Uvarint(buf[1:n])
+		if size <= 0 {
+			continue
+		}
+		t.mu.Lock()
+		if acked, exists := t.pending[seq]; exists {
+			close(acked)
+			delete(t.pending, seq)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// serveUDP applies datagram batches from peers and acks each one, including
+// retransmits of batches already applied, which merge as no-ops
+func (m *LWWMap) serveUDP(conn *net.UDPConn) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("Node %s stopped serving UDP: %v", m.nodeID, err)
+			return
+		}
+		datagram, signed := verify(buf[:n], m.peerSecret)
+		if !signed {
+			log.Printf("Node %s dropped unsigned datagram from %v", m.nodeID, addr)
+			continue
+		}
+		seq, peer, operations, err := decodeOps(datagram)
+		if err != nil {
+			log.Printf("Node %s received malformed datagram from %v: %v", m.nodeID, addr, err)
+			// a newer peer isn't misbehaving, and without a node ID there
+			// is no one to hold to account
+			if errors.Is(err, errMalformedDatagram) && peer != "" {
+				m.gossipFailure(peer)
+			}
+			continue
+		}
+		if m.quarantine.quarantined(peer) {
+			continue
+		}
+		if m.strictUTF8 && !validUTF8(operations) {
+			log.Printf("Node %s received datagram with invalid UTF-8 from node %s", m.nodeID, peer)
+			m.gossipFailure(peer)
+			// acked like a 4xx answer: resending it won't help
+			m.ackDatagram(conn, addr, seq)
+			continue
+		}
+		// unacked batches are retransmitted, which is how a peer over
+		// its quota slows down
+		if m.originQuota != nil && !m.originQuota.allow(peer, len(operations)) {
+			continue
+		}
+		if m.recorder != nil {
+			m.recorder.record(peer, operations)
+		}
+		m.Apply(operations)
+		m.ackDatagram(conn, addr, seq)
+	}
+}
+
+func (m *LWWMap) ackDatagram(conn *net.UDPConn, addr *net.UDPAddr, seq uint64) {
+	ack := binary.AppendUvarint([]byte{datagramAck}, seq)
+	if _, err := conn.WriteToUDP(ack, addr); err != nil {
+		log.Printf("Node %s failed to ack datagram to %v: %v", m.nodeID, addr, err)
+	}
+}
+
+func validUTF8(operations []Patch) bool {
+	for _, op := range operations {
+		if !utf8.ValidString(op.Key) || !utf8.ValidString(op.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// packDatagrams splits operations into batches that each encode within
+// maxDatagram, and returns apart those too large for any datagram
+func packDatagrams(nodeID string, operations []Patch) (batches [][]Patch, oversized []Patch) {
+	// room is always left for a signature
+	header := 2 + binary.MaxVarintLen64 + binary.MaxVarintLen64 + len(nodeID) + binary.MaxVarintLen64 + sha256.Size
+	size := header
+	var batch []Patch
+	for _, op := range operations {
+		opSize := 3*binary.MaxVarintLen64 + len(op.Key) + len(op.Value) + len(op.Node) + 3*binary.MaxVarintLen64
+		if header+opSize > maxDatagram {
+			oversized = append(oversized, op)
+			continue
+		}
+		if size+opSize > maxDatagram {
+			batches = append(batches, batch)
+			batch, size = nil, header
+		}
+		batch = append(batch, op)
+		size += opSize
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, oversized
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func encodeOps(seq uint64, nodeID string, operations []Patch) []byte {
+	buf := []byte{datagramOps, datagramVersion}
+	buf = binary.AppendUvarint(buf, seq)
+	buf = appendString(buf, nodeID)
+	buf = binary.AppendUvarint(buf, uint64(len(operations)))
+	for _, op := range operations {
+		buf = appendString(buf, op.Key)
+		buf = appendString(buf, op.Value)
+		buf = binary.AppendVarint(buf, int64(op.Timestamp))
+		buf = binary.AppendVarint(buf, op.Wall)
+		buf = appendString(buf, op.Node)
+		buf = binary.AppendUvarint(buf, op.Version)
+	}
+	return buf
+}
+
+// datagramReader decodes a datagram, remembering the first error
+type datagramReader struct {
+	buf []byte
+	err error
+}
+
+func (r *datagramReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errMalformedDatagram
+		r.buf = nil
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *datagramReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errMalformedDatagram
+		r.buf = nil
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *datagramReader) string() string {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.err = errMalformedDatagram
+		r.buf = nil
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+// decodeOps returns the sender's node ID along with an error when the
+// datagram was readable that far
+func decodeOps(datagram []byte) (seq uint64, nodeID string, operations []Patch, err error) {
+	if len(datagram) < 2 || datagram[0] != datagramOps {
+		return 0, "", nil, errMalformedDatagram
+	}
+	if datagram[1] != datagramVersion {
+		return 0, "", nil, errDatagramVersion
+	}
+	r := &datagramReader{buf: datagram[2:]}
+	seq = r.uvarint()
+	nodeID = r.string()
+	if r.err != nil {
+		return 0, "", nil, errMalformedDatagram
+	}
+	count := r.uvarint()
+	// every operation takes at least six bytes
+	if count > uint64(len(r.buf)) {
+		return 0, nodeID, nil, errMalformedDatagram
+	}
+	operations = make([]Patch, 0, count)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		operations = append(operations, Patch{Key: r.string(), Value: r.string(), Timestamp: Clock(r.varint()), Wall: r.varint(), Node: r.string(), Version: r.uvarint()})
+	}
+	if r.err != nil || len(r.buf) != 0 || nodeID == "" {
+		return 0, nodeID, nil, errMalformedDatagram
+	}
+	return seq, nodeID, operations, nil
+}
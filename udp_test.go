@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// lossyProxy relays datagrams between senders and the node behind target,
+// dropping the first one it receives from a sender
+func lossyProxy(t *testing.T, target *net.UDPAddr) (*net.UDPConn, *atomic.Int32) {
+	proxy := listenLoopback(t)
+	var dropped atomic.Int32
+	go func() {
+		var sender *net.UDPAddr
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := proxy.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if addr.String() == target.String() {
+				proxy.WriteToUDP(buf[:n], sender)
+				continue
+			}
+			sender = addr
+			if dropped.CompareAndSwap(0, 1) {
+				continue
+			}
+			proxy.WriteToUDP(buf[:n], target)
+		}
+	}()
+	return proxy, &dropped
+}
+
+func TestUDPRetransmitsDroppedDatagram(t *testing.T) {
+	receiver := NewLWWMap("receiver", nil)
+	conn := listenLoopback(t)
+	go receiver.serveUDP(conn)
+	proxy, dropped := lossyProxy(t, conn.LocalAddr().(*net.UDPAddr))
+
+	port := proxy.LocalAddr().(*net.UDPAddr).Port
+	transport, err := NewUDPTransport(NewHTTPTransport("sender"), port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.timeout = 20 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replica := "127.0.0.1:" + strconv.Itoa(port)
+	if err := transport.SendOps(ctx, replica, []Patch{{Key: "k", Value: "v", Timestamp: 3}}); err != nil {
+		t.Fatalf("SendOps: %v", err)
+	}
+	if dropped.Load() != 1 {
+		t.Fatal("proxy dropped nothing")
+	}
+	if data := mustGet(t, receiver, "k"); data.Value != "v" || data.Timestamp != 3 {
+		t.Fatalf("got %+v", data)
+	}
+}
+
+func TestDecodeOpsChecksVersion(t *testing.T) {
+	datagram := encodeOps(7, "n1", []Patch{{Key: "k", Value: "v", Timestamp: 3, Wall: 9}})
+
+	seq, node, operations, err := decodeOps(datagram)
+	if err != nil || seq != 7 || node != "n1" || len(operations) != 1 || operations[0].Wall != 9 {
+		t.Fatalf("round trip gave %d %q %+v %v", seq, node, operations, err)
+	}
+
+	datagram[1] = datagramVersion + 1
+	if _, _, _, err := decodeOps(datagram); !errors.Is(err, errDatagramVersion) {
+		t.Fatalf("got %v, want a version error", err)
+	}
+}
+
+func TestMalformedDatagramsCountTowardsQuarantine(t *testing.T) {
+	receiver := NewLWWMap("receiver", nil)
+	receiver.quarantine.threshold = 2
+	// without a peer secret only node IDs a replica answered as are counted
+	receiver.quarantine.learn("n1:8080", "n1")
+	conn := listenLoopback(t)
+	go receiver.serveUDP(conn)
+
+	sender := listenLoopback(t)
+	datagram := encodeOps(1, "n1", write("k", "v"))
+	// cut inside the operation, after the node ID
+	truncated := datagram[:len(datagram)-3]
+	for range 2 {
+		sender.WriteToUDP(truncated, conn.LocalAddr().(*net.UDPAddr))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !receiver.quarantine.quarantined("n1") {
+		if time.Now().After(deadline) {
+			t.Fatal("n1 was not quarantined")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
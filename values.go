@@ -0,0 +1,45 @@
+package main
+
+import "crypto/sha256"
+
+type valueRef struct {
+	value string
+	refs  int
+}
+
+// valuePool stores each distinct value once, keyed by its hash, so keys
+// holding identical values share one backing copy
+type valuePool struct {
+	values map[[sha256.Size]byte]*valueRef
+}
+
+func newValuePool() *valuePool {
+	return &valuePool{
+		values: make(map[[sha256.Size]byte]*valueRef),
+	}
+}
+
+// intern returns the shared copy of value and takes a reference on it
+func (p *valuePool) intern(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	ref, exists := p.values[sum]
+	if !exists {
+		ref = &valueRef{value: value}
+		p.values[sum] = ref
+	}
+	ref.refs++
+	return ref.value
+}
+
+// release drops a reference taken by intern, freeing the copy on the last one
+func (p *valuePool) release(value string) {
+	sum := sha256.Sum256([]byte(value))
+	ref, exists := p.values[sum]
+	if !exists {
+		return
+	}
+	ref.refs--
+	if ref.refs <= 0 {
+		delete(p.values, sum)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestIdenticalValuesShareOneCopy(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	m.values = newValuePool()
+	large := strings.Repeat("x", 1<<20)
+	for i := range 100 {
+		// every write brings its own copy of the value
+		m.ApplyClient(write(fmt.Sprintf("k%d", i), strings.Clone(large)))
+	}
+
+	if len(m.values.values) != 1 {
+		t.Fatalf("pool holds %d values, want 1", len(m.values.values))
+	}
+	first := unsafe.StringData(mustGet(t, m, "k0").Value)
+	for i := range 100 {
+		if unsafe.StringData(mustGet(t, m, fmt.Sprintf("k%d", i)).Value) != first {
+			t.Fatalf("k%d has its own copy of the value", i)
+		}
+	}
+
+	// overwriting every key releases the last reference
+	for i := range 100 {
+		m.ApplyClient(write(fmt.Sprintf("k%d", i), "small"))
+	}
+	for _, ref := range m.values.values {
+		if ref.value == large {
+			t.Fatal("the large value is still pooled after every key moved off it")
+		}
+	}
+	if len(m.values.values) != 1 {
+		t.Fatalf("pool holds %d values, want only the small one", len(m.values.values))
+	}
+}
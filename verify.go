@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Verification is the outcome of replaying the store file against what the
+// node holds in memory
+type Verification struct {
+	Keys       int      `json:"keys"`
+	Mismatches []string `json:"mismatches"`
+}
+
+// verify replays the store file from disk and checks it reproduces the
+// in-memory state: the offset of every key's last entry and the bucket
+// hashes set keeps up to date. Writes wait until it is done. It reports
+// false when the store isn't a file.
+func (m *LWWMap) verify() (Verification, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, persisted := m.store.(*fileStore)
+	if !persisted {
+		return Verification{}, false, nil
+	}
+	file, err := os.Open(s.file.Name())
+	if err != nil {
+		return Verification{}, true, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadBytes('\n')
+	if err != nil {
+		return Verification{}, true, err
+	}
+	replayed := make(map[string]fileEntry)
+	index := make(map[string]span)
+	size, err := replayEntries(reader, int64(len(header)), func(entry fileEntry, sp span) {
+		replayed[entry.Key] = entry
+		index[entry.Key] = sp
+	})
+	if err != nil {
+		return Verification{}, true, err
+	}
+
+	result := Verification{Keys: len(replayed), Mismatches: []string{}}
+	mismatch := func(format string, args ...any) {
+		result.Mismatches = append(result.Mismatches, fmt.Sprintf(format, args...))
+	}
+	if size != s.size {
+		mismatch("file replays to %d bytes, the store appends at %d", size, s.size)
+	}
+	if len(replayed) != s.Len() {
+		mismatch("file holds %d keys, the store %d", len(replayed), s.Len())
+	}
+	var buckets [merkleBuckets][sha256.Size]byte
+	for key, entry := range replayed {
+		if sp, exists := s.index[key]; !exists || sp != index[key] {
+			mismatch("key %q is at %+v in memory, its last entry at %+v", key, s.index[key], index[key])
+		}
+		digest := entryDigest(key, entry.Data)
+		for i := range digest {
+			buckets[bucketOf(key)][i] ^= digest[i]
+		}
+	}
+	for i := range buckets {
+		if buckets[i] != m.buckets[i] {
+			mismatch("bucket %d hashes to %s in memory, %s replayed", i, hex.EncodeToString(m.buckets[i][:]), hex.EncodeToString(buckets[i][:]))
+		}
+	}
+	return result, true, nil
+}
+
+// Verify replays the store file on demand, answering 500 on a mismatch
+func (m *LWWMap) Verify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, persisted, err := m.verify()
+	if !persisted {
+		http.Error(w, "Store is not persisted", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(result.Mismatches) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (m *LWWMap) verifyPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		result, _, err := m.verify()
+		switch {
+		case err != nil:
+			log.Printf("Node %s failed to verify its store: %v", m.nodeID, err)
+		case len(result.Mismatches) > 0:
+			log.Printf("Node %s STORE MISMATCH, the file does not replay to the state in memory: %v", m.nodeID, result.Mismatches)
+		}
+	}
+}
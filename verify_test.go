@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func verifyStatus(m *LWWMap) int {
+	w := httptest.NewRecorder()
+	m.Verify(w, httptest.NewRequest(http.MethodGet, "/verify", nil))
+	return w.Code
+}
+
+func TestVerifyDetectsAMismatch(t *testing.T) {
+	store, err := OpenFileStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(*fileStore).file.Close()
+	m := NewLWWMapWithStore("n0", nil, nil, store)
+	for i := range 10 {
+		m.ApplyClient(write(fmt.Sprintf("k%d", i%4), "v"))
+	}
+	if code := verifyStatus(m); code != http.StatusOK {
+		t.Fatalf("consistent store got status %d", code)
+	}
+
+	// a write path bug leaves a key pointing at an entry it overwrote
+	s := store.(*fileStore)
+	first := s.index["k0"]
+	m.ApplyClient(write("k0", "new"))
+	fixed := s.index["k0"]
+	s.index["k0"] = first
+	if result, _, _ := m.verify(); len(result.Mismatches) == 0 {
+		t.Fatal("stale offset went unnoticed")
+	}
+	s.index["k0"] = fixed
+
+	// or forgets to update a bucket hash
+	m.buckets[bucketOf("k1")][0] ^= 1
+	if code := verifyStatus(m); code != http.StatusInternalServerError {
+		t.Fatalf("stale bucket hash got status %d, want 500", code)
+	}
+	m.buckets[bucketOf("k1")][0] ^= 1
+	if code := verifyStatus(m); code != http.StatusOK {
+		t.Fatalf("repaired store got status %d", code)
+	}
+}
+
+func TestVerifyNeedsAFileStore(t *testing.T) {
+	if code := verifyStatus(NewLWWMap("n0", nil)); code != http.StatusNotFound {
+		t.Fatalf("memory store got status %d, want 404", code)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ViewOptions struct {
+	// changes buffered before the view gives up and rebuilds from the store
+	Buffer int
+	// how long changes are collected before a new map is published
+	Debounce time.Duration
+}
+
+type ViewLag struct {
+	Pending     int
+	SinceUpdate time.Duration
+}
+
+type viewChange struct {
+	key  string
+	data Data
+}
+
+// MaterializedView is a read-only map of the keys under a prefix that is
+// safe to read without locking. Each update publishes a fresh immutable map,
+// so readers never see a half-applied batch.
+type MaterializedView struct {
+	m      *LWWMap
+	prefix string
+	opts   ViewOptions
+
+	changes    chan viewChange
+	overflowed atomic.Bool
+	current    atomic.Pointer[map[string]string]
+	lastUpdate atomic.Int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (m *LWWMap) NewView(prefix string, opts ViewOptions) *MaterializedView {
+	if opts.Buffer <= 0 {
+		opts.Buffer = 1024
+	}
+	if opts.Debounce <= 0 {
+		opts.Debounce = 10 * time.Millisecond
+	}
+
+	v := &MaterializedView{
+		m:       m,
+		prefix:  m.key(prefix),
+		opts:    opts,
+		changes: make(chan viewChange, opts.Buffer),
+		done:    make(chan struct{}),
+	}
+
+	// subscribing and scanning under one lock leaves no gap between them
+	m.mu.Lock()
+	m.views[v] = struct{}{}
+	entries := m.scanPrefix(v.prefix)
+	m.mu.Unlock()
+
+	v.publish(entries, nil)
+	go v.run()
+	return v
+}
+
+// scanPrefix returns the stored entries under prefix, m.mu must be held
+func (m *LWWMap) scanPrefix(prefix string) map[string]Data {
+	entries := make(map[string]Data)
+	for key, data := range m.store.All() {
+		if strings.HasPrefix(key, prefix) {
+			entries[key] = data
+		}
+	}
+	return entries
+}
+
+// notify is called by set with m.mu held and must never block
+func (v *MaterializedView) notify(key string, data Data) {
+	if !strings.HasPrefix(key, v.prefix) {
+		return
+	}
+	select {
+	case v.changes <- viewChange{key: key, data: data}:
+	default:
+		v.overflowed.Store(true)
+	}
+}
+
+func (v *MaterializedView) Get(key string) (string, bool) {
+	value, exists := (*v.current.Load())[key]
+	return value, exists
+}
+
+// Snapshot returns the current map. It is shared and must not be modified.
+func (v *MaterializedView) Snapshot() map[string]string {
+	return *v.current.Load()
+}
+
+func (v *MaterializedView) Lag() ViewLag {
+	return ViewLag{
+		Pending:     len(v.changes),
+		SinceUpdate: time.Since(time.Unix(0, v.lastUpdate.Load())),
+	}
+}
+
+func (v *MaterializedView) Close() {
+	v.closeOnce.Do(func() {
+		v.m.mu.Lock()
+		delete(v.m.views, v)
+		v.m.mu.Unlock()
+		close(v.done)
+	})
+}
+
+func (v *MaterializedView) run() {
+	for {
+		var batch []viewChange
+		select {
+		case <-v.done:
+			return
+		case change := <-v.changes:
+			batch = append(batch, change)
+		}
+
+		debounce := time.NewTimer(v.opts.Debounce)
+	collect:
+		for {
+			select {
+			case <-v.done:
+				debounce.Stop()
+				return
+			case change := <-v.changes:
+				batch = append(batch, change)
+			case <-debounce.C:
+				break collect
+			}
+		}
+
+		if v.overflowed.Load() {
+			v.rebuild()
+			continue
+		}
+		// set notifies under the store lock, so no locked batch is half
+		// sent while we hold it: the drain picks up the rest of any batch
+		// the debounce cut in two
+		v.m.mu.Lock()
+		for len(v.changes) > 0 {
+			batch = append(batch, <-v.changes)
+		}
+		v.m.mu.Unlock()
+		v.publish(nil, batch)
+	}
+}
+
+// rebuild replaces the view with a fresh scan after changes were dropped.
+// Draining under the store lock discards exactly the changes the scan
+// already covers.
+func (v *MaterializedView) rebuild() {
+	v.m.mu.Lock()
+	for len(v.changes) > 0 {
+		<-v.changes
+	}
+	v.overflowed.Store(false)
+	entries := v.m.scanPrefix(v.prefix)
+	v.m.mu.Unlock()
+
+	log.Printf("Node %s rebuilt view of %q after overflow", v.m.nodeID, v.prefix)
+	v.publish(entries, nil)
+}
+
+// publish swaps in a new map: entries replaces the contents when non-nil,
+// otherwise batch is applied on top of a copy of the current map
+func (v *MaterializedView) publish(entries map[string]Data, batch []viewChange) {
+	next := make(map[string]string)
+	if entries == nil {
+		for key, value := range *v.current.Load() {
+			next[key] = value
+		}
+		entries = make(map[string]Data, len(batch))
+		for _, change := range batch {
+			entries[change.key] = change.data
+		}
+	}
+
+	for key, data := range entries {
+		data, err := v.m.afterRead(context.Background(), key, data)
+		if err != nil {
+			log.Printf("View of %q failed to read %s: %v", v.prefix, key, err)
+			continue
+		}
+		next[key] = data.Value
+	}
+
+	v.current.Store(&next)
+	v.lastUpdate.Store(time.Now().UnixNano())
+}
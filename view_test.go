@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestViewHasNoTornReads writes pairs of keys in one batch while readers spin
+// on the view. A snapshot holding one key of a pair at a newer value than the
+// other would be a half-applied batch.
+func TestViewHasNoTornReads(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	view := m.NewView("pair/", ViewOptions{Buffer: 64, Debounce: time.Millisecond})
+	defer view.Close()
+
+	const writes = 2000
+	var stop atomic.Bool
+	var torn atomic.Int64
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				snapshot := view.Snapshot()
+				if snapshot["pair/a"] != snapshot["pair/b"] {
+					torn.Add(1)
+				}
+			}
+		}()
+	}
+
+	for i := range writes {
+		value := strconv.Itoa(i)
+		m.ApplyClient([]Patch{
+			{Key: "pair/a", Value: value, Timestamp: -1},
+			{Key: "pair/b", Value: value, Timestamp: -1},
+		})
+	}
+
+	// the view catches up shortly after the writes stop
+	last := strconv.Itoa(writes - 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for value, _ := view.Get("pair/a"); value != last; value, _ = view.Get("pair/a") {
+		if time.Now().After(deadline) {
+			t.Fatalf("view still has %q 2s after the last write, lag %+v", value, view.Lag())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	if n := torn.Load(); n > 0 {
+		t.Fatalf("readers saw %d torn snapshots", n)
+	}
+	if lag := view.Lag(); lag.Pending != 0 {
+		t.Fatalf("got %d changes pending after catching up", lag.Pending)
+	}
+}
+
+func TestClosedViewUnsubscribes(t *testing.T) {
+	m := NewLWWMap("n0", nil)
+	view := m.NewView("", ViewOptions{})
+	view.Close()
+	view.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.views) != 0 {
+		t.Fatal("a closed view is still subscribed")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// responses for virtual keys carry this header
+const virtualHeader = "X-Virtual-Key"
+
+// virtual keys are computed on read instead of stored, so they never
+// replicate and never show up in hashes or pushes
+func (m *LWWMap) registerBuiltinVirtualKeys() {
+	m.RegisterVirtualKey("__stats/keycount", func() string {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return strconv.Itoa(m.store.Len())
+	})
+	m.RegisterVirtualKey("__cluster/members", func() string {
+		return strings.Join(append([]string{m.nodeID}, m.replicas...), ",")
+	})
+}
+
+func (m *LWWMap) RegisterVirtualKey(key string, value func() string) {
+	m.virtualMu.Lock()
+	defer m.virtualMu.Unlock()
+	m.virtualKeys[key] = value
+}
+
+// virtualKey returns the function computing key's value if key is virtual
+func (m *LWWMap) virtualKey(key string) (func() string, bool) {
+	m.virtualMu.RLock()
+	defer m.virtualMu.RUnlock()
+	value, found := m.virtualKeys[key]
+	return value, found
+}
+
+// read looks key up in the virtual registry, then the store, then peers when
+// read-through is on, passing stored values through the read interceptors
+func (m *LWWMap) read(ctx context.Context, key string) (data Data, virtual bool, exists bool, err error) {
+	key = m.key(key)
+	if value, found := m.virtualKey(key); found {
+		return Data{Value: value()}, true, true, nil
+	}
+
+	data, exists = m.lookup(key)
+	if !exists && m.readThrough != nil && m.fetchFromPeers(ctx, key) {
+		data, exists = m.lookup(key)
+	}
+	if !exists {
+		return data, false, false, nil
+	}
+	data, err = m.afterRead(ctx, key, data)
+	return data, false, true, err
+}
+
+// lookup returns the stored entry for key as is
+func (m *LWWMap) lookup(key string) (Data, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, exists := m.store.Get(m.key(key))
+	return data, exists
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVirtualKeysStayOutOfReplication(t *testing.T) {
+	nodes, _ := newCluster(2, NewMemoryStore)
+	n0, n1 := nodes[0], nodes[1]
+	n0.RegisterVirtualKey("__app/answer", func() string { return "42" })
+	n0.ApplyClient(write("k", "v"))
+	n1.Apply(n0.snapshot())
+
+	if _, keys := n0.keyspaceHash(); keys != 1 {
+		t.Fatalf("got %d keys in the hash, want only the stored one", keys)
+	}
+	if writesHash(n0) != writesHash(n1) {
+		t.Fatal("a virtual key made the hashes differ")
+	}
+	for _, op := range n0.snapshot() {
+		if strings.HasPrefix(op.Key, "__") {
+			t.Fatalf("snapshot pushes virtual key %s", op.Key)
+		}
+	}
+	export, err := n0.export(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Entries) != 1 || export.Entries[0].Key != "k" {
+		t.Fatalf("got export %+v, want only k", export.Entries)
+	}
+}
+
+func TestVirtualKeysAreServedAndMarked(t *testing.T) {
+	m := NewLWWMap("n0", []string{"n1"})
+	m.ApplyClient(write("a", "1"))
+	m.ApplyClient(write("b", "2"))
+
+	for key, want := range map[string]string{"__stats/keycount": "2", "__cluster/members": "n0,n1"} {
+		w := httptest.NewRecorder()
+		m.GetRaw(w, httptest.NewRequest(http.MethodGet, "/getRaw?key="+key, nil))
+		if w.Body.String() != want || w.Header().Get(virtualHeader) != "true" {
+			t.Fatalf("got %q with %s=%q for %s, want %q marked virtual", w.Body, virtualHeader, w.Header().Get(virtualHeader), key, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	m.GetRaw(w, httptest.NewRequest(http.MethodGet, "/getRaw?key=a", nil))
+	if w.Header().Get(virtualHeader) != "" {
+		t.Fatal("a stored key was marked virtual")
+	}
+}